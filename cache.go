@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"reflect"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+// streamsCache holds the merged (and sorted, unless -no-sort) streams of the
+// input files, along with their checksums to detect changes. Lenient is
+// whether malformed records were skipped, so that a strict run never reuses
+// what a lenient one salvaged, and Pattern the -pattern that selected the
+// entries of zip archives.
+type streamsCache struct {
+	Checksums map[string]string   `json:"checksums"`
+	Sorted    bool                `json:"sorted"`
+	Lenient   bool                `json:"lenient"`
+	Pattern   string              `json:"pattern"`
+	Streams   []endsong.Stream    `json:"streams"`
+	Files     []endsong.FileStats `json:"files"`
+}
+
+// checksumFiles returns the hex SHA-256 of each file, keyed by file name.
+func checksumFiles(fileNames []string) map[string]string {
+	checksums := make(map[string]string)
+	for _, fileName := range fileNames {
+		f, err := os.Open(fileName)
+		if err != nil {
+			fatal("Error when opening file: ", err)
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, f)
+		f.Close()
+		if err != nil {
+			fatal("Error when reading file: ", err)
+		}
+		checksums[fileName] = hex.EncodeToString(h.Sum(nil))
+	}
+	return checksums
+}
+
+// readStreamsCache returns the cached streams and file stats if the cache was
+// built from the same input files with the same sorting, leniency and pattern
+// as key. A missing or unreadable cache, or one written before file stats were
+// cached, is simply a miss.
+func readStreamsCache(fileName string, key streamsCache) (streamsCache, bool) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return key, false
+	}
+	defer f.Close()
+
+	var cache streamsCache
+	if err := json.NewDecoder(f).Decode(&cache); err != nil {
+		printWarning("Ignoring unreadable cache %s: %v", fileName, err)
+		return key, false
+	}
+	if cache.Sorted != key.Sorted || cache.Lenient != key.Lenient || cache.Pattern != key.Pattern ||
+		!reflect.DeepEqual(cache.Checksums, key.Checksums) || cache.Files == nil {
+		return key, false
+	}
+
+	printDone("%s done!", fileName)
+	return cache, true
+}
+
+func writeStreamsCache(fileName string, cache streamsCache) {
+	err := writeFileAtomically(fileName, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return enc.Encode(cache)
+	})
+	if err != nil {
+		fatal("Error when writing file: ", err)
+	}
+}
+
+// readMetadataFile reads a track ID to artwork mapping.
+func readMetadataFile(fileName string) map[string]endsong.Artwork {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		fatal("Error when opening file: ", err)
+	}
+
+	var artworkByID map[string]endsong.Artwork
+	if err := json.Unmarshal(content, &artworkByID); err != nil {
+		fatal("Error during Unmarshal(): ", err)
+	}
+	printDone("%s done!", fileName)
+
+	return artworkByID
+}
+
+// artworkCacheFile persists the artwork of every track resolved so far across
+// runs, keyed by track ID, so that only new tracks hit the API.
+const artworkCacheFile = ".artwork_cache.json"
+
+// episodeArtworkCacheFile is the artwork cache of podcast episodes, keyed by
+// episode ID.
+const episodeArtworkCacheFile = ".episode_artwork_cache.json"
+
+// artistArtworkCacheFile is the cache of the artist images used for tracks
+// whose album has none, keyed by artist ID.
+const artistArtworkCacheFile = ".artist_artwork_cache.json"
+
+// readArtworkCache reads the artworks cached by previous runs. A missing cache
+// is empty.
+func readArtworkCache(fileName string) map[string]endsong.Artwork {
+	artworkByID := make(map[string]endsong.Artwork)
+
+	content, err := os.ReadFile(fileName)
+	if os.IsNotExist(err) {
+		return artworkByID
+	}
+	if err != nil {
+		fatal("Error when opening file: ", err)
+	}
+	if err := json.Unmarshal(content, &artworkByID); err != nil {
+		printWarning("Ignoring unreadable cache %s: %v", fileName, err)
+		return make(map[string]endsong.Artwork)
+	}
+	printDone("%s done!", fileName)
+
+	return artworkByID
+}
+
+// writeArtworkCache replaces the artwork cache at once, so that being killed
+// mid-write, e.g. by a second interrupt, doesn't leave it unreadable.
+func writeArtworkCache(fileName string, artworkByID map[string]endsong.Artwork) {
+	err := writeFileAtomically(fileName, func(w io.Writer) error {
+		enc := json.NewEncoder(w)
+		enc.SetEscapeHTML(false)
+		return enc.Encode(artworkByID)
+	})
+	if err != nil {
+		fatal("Error when writing file: ", err)
+	}
+}
+
+// referencedIDs returns the track and episode IDs of the streams of all sets.
+func referencedIDs(streamSets ...[]endsong.Stream) (trackIDs, episodeIDs map[string]bool) {
+	trackIDs = make(map[string]bool)
+	episodeIDs = make(map[string]bool)
+	for _, allStreams := range streamSets {
+		for _, s := range allStreams {
+			if episodeID, ok := endsong.EpisodeIDFromURI(s.SpotifyEpisodeURI); ok {
+				episodeIDs[episodeID] = true
+			} else if trackID, ok := endsong.TrackIDFromURI(s.SpotifyTrackURI); ok {
+				trackIDs[trackID] = true
+			}
+		}
+	}
+	return trackIDs, episodeIDs
+}
+
+// pruneArtworkCache removes the artworks whose ID isn't referenced from the
+// cache, and returns how many were removed.
+func pruneArtworkCache(artworkByID map[string]endsong.Artwork, referenced map[string]bool) int {
+	pruned := 0
+	for id := range artworkByID {
+		if !referenced[id] {
+			delete(artworkByID, id)
+			pruned++
+		}
+	}
+	return pruned
+}
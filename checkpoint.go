@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+const (
+	// checkpointFile holds the artworks fetched by an unfinished run.
+	checkpointFile = ".artwork_checkpoint.json"
+	// checkpointInterval is the number of fetched artworks between writes of
+	// the checkpoint file.
+	checkpointInterval = 500
+)
+
+// checkpoint is the content of the checkpoint file.
+type checkpoint struct {
+	Tracks   map[string]endsong.Artwork `json:"tracks"`
+	Episodes map[string]endsong.Artwork `json:"episodes"`
+}
+
+// checkpointer periodically saves the artworks fetched so far, so that an
+// interrupted run can resume from them. A nil checkpointer does nothing.
+type checkpointer struct {
+	mu        sync.Mutex
+	fileName  string
+	saved     checkpoint
+	unwritten int
+}
+
+// newCheckpointer returns a checkpointer writing to fileName, along with the
+// checkpoint left there by a previous run, which is empty if there is none.
+func newCheckpointer(fileName string) (*checkpointer, checkpoint) {
+	previous := checkpoint{Tracks: make(map[string]endsong.Artwork), Episodes: make(map[string]endsong.Artwork)}
+	content, err := os.ReadFile(fileName)
+	if err != nil && !os.IsNotExist(err) {
+		fatal("Error when opening file: ", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(content, &previous); err != nil {
+			printWarning("Ignoring unreadable checkpoint %s: %v", fileName, err)
+		} else {
+			printWarning("Resuming from %s: %d tracks and %d episodes already fetched.", fileName, len(previous.Tracks), len(previous.Episodes))
+		}
+	}
+
+	cp := &checkpointer{fileName: fileName, saved: checkpoint{Tracks: make(map[string]endsong.Artwork), Episodes: make(map[string]endsong.Artwork)}}
+	for trackID, artwork := range previous.Tracks {
+		cp.saved.Tracks[trackID] = artwork
+	}
+	for episodeID, artwork := range previous.Episodes {
+		cp.saved.Episodes[episodeID] = artwork
+	}
+	return cp, previous
+}
+
+// addTrack records the artwork of a fetched track.
+func (cp *checkpointer) addTrack(trackID string, artwork endsong.Artwork) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.saved.Tracks[trackID] = artwork
+	cp.added()
+}
+
+// addEpisode records the artwork of a fetched episode.
+func (cp *checkpointer) addEpisode(episodeID string, artwork endsong.Artwork) {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	cp.saved.Episodes[episodeID] = artwork
+	cp.added()
+}
+
+func (cp *checkpointer) added() {
+	cp.unwritten++
+	if cp.unwritten >= checkpointInterval {
+		cp.write()
+	}
+}
+
+// flush writes the artworks not yet in the checkpoint file.
+func (cp *checkpointer) flush() {
+	if cp == nil {
+		return
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.unwritten > 0 {
+		cp.write()
+	}
+}
+
+func (cp *checkpointer) write() {
+	content, err := json.Marshal(cp.saved)
+	if err != nil {
+		fatal("Error when encoding checkpoint: ", err)
+	}
+	err = writeFileAtomically(cp.fileName, func(w io.Writer) error {
+		_, err := w.Write(content)
+		return err
+	})
+	if err != nil {
+		printWarning("Error when writing checkpoint %s: %v", cp.fileName, err)
+		return
+	}
+	cp.unwritten = 0
+}
+
+// remove deletes the checkpoint file once the run has succeeded.
+func (cp *checkpointer) remove() {
+	if cp == nil {
+		return
+	}
+	if err := os.Remove(cp.fileName); err != nil && !os.IsNotExist(err) {
+		printWarning("Error when removing checkpoint %s: %v", cp.fileName, err)
+	}
+}
+
+// exitInterrupted flushes the checkpoint and exits after the run was
+// interrupted.
+func (cp *checkpointer) exitInterrupted() {
+	if cp == nil {
+		printWarning("Interrupted.")
+		os.Exit(130)
+	}
+	cp.flush()
+	printWarning("Interrupted, progress saved to %s.", cp.fileName)
+	os.Exit(130)
+}
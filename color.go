@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"golang.org/x/term"
+)
+
+const (
+	colorReset  = "\033[0m"
+	colorRed    = "\033[31m"
+	colorGreen  = "\033[32m"
+	colorYellow = "\033[33m"
+)
+
+// Whether ANSI colors are written to stdout and stderr, set by setupColor.
+var (
+	stdoutColor bool
+	stderrColor bool
+)
+
+// setupColor enables colored messages according to mode: "always", "never",
+// or "auto" to only color output going to a terminal.
+func setupColor(mode string) {
+	switch mode {
+	case "always":
+		stdoutColor, stderrColor = true, true
+	case "never":
+		stdoutColor, stderrColor = false, false
+	case "auto":
+		stdoutColor = term.IsTerminal(int(os.Stdout.Fd()))
+		stderrColor = term.IsTerminal(int(os.Stderr.Fd()))
+	default:
+		fatalf("invalid -color value %q: must be auto, always or never", mode)
+	}
+}
+
+func colorize(color string, s string, enabled bool) string {
+	if !enabled {
+		return s
+	}
+	return color + s + colorReset
+}
+
+// printDone prints a success message, in green when enabled.
+func printDone(format string, a ...interface{}) {
+	logger.Log(context.Background(), levelDone, fmt.Sprintf(format, a...))
+}
+
+// printInfo prints a progress message, hidden by -quiet.
+func printInfo(format string, a ...interface{}) {
+	logger.Info(fmt.Sprintf(format, a...))
+}
+
+// printDebug prints a detail only shown with -verbose.
+func printDebug(format string, a ...interface{}) {
+	logger.Debug(fmt.Sprintf(format, a...))
+}
+
+// printWarning prints a warning message, in yellow when enabled.
+func printWarning(format string, a ...interface{}) {
+	logger.Warn(fmt.Sprintf(format, a...))
+}
+
+// cliLogger prints the messages of the endsong package like the others.
+type cliLogger struct{}
+
+func (cliLogger) Printf(format string, a ...interface{}) { printInfo(format, a...) }
+func (cliLogger) Warnf(format string, a ...interface{})  { printWarning(format, a...) }
+
+// fatal prints an error message, in red when enabled, and exits.
+func fatal(v ...interface{}) {
+	logger.Error(fmt.Sprint(v...))
+	os.Exit(1)
+}
+
+// fatalf prints a formatted error message, in red when enabled, and exits.
+func fatalf(format string, v ...interface{}) {
+	logger.Error(fmt.Sprintf(format, v...))
+	os.Exit(1)
+}
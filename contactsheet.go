@@ -0,0 +1,91 @@
+package main
+
+import (
+	"image"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"sort"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+// topArtworkURLs returns the n artwork URLs with the most plays.
+func topArtworkURLs(allStreams []endsong.Stream, n int) []string {
+	playsByURL := make(map[string]int)
+	for _, s := range allStreams {
+		if s.ArtworkURL != nil {
+			playsByURL[*s.ArtworkURL]++
+		}
+	}
+
+	urls := make([]string, 0, len(playsByURL))
+	for url := range playsByURL {
+		urls = append(urls, url)
+	}
+	sort.Slice(urls, func(i, j int) bool {
+		if playsByURL[urls[i]] != playsByURL[urls[j]] {
+			return playsByURL[urls[i]] > playsByURL[urls[j]]
+		}
+		return urls[i] < urls[j]
+	})
+	if len(urls) > n {
+		urls = urls[:n]
+	}
+
+	return urls
+}
+
+func downloadImage(url string) (image.Image, error) {
+	body, err := openURL(url)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	img, _, err := image.Decode(body)
+	return img, err
+}
+
+// drawScaled draws src into the r rectangle of dst, using nearest-neighbour
+// scaling.
+func drawScaled(dst draw.Image, r image.Rectangle, src image.Image) {
+	b := src.Bounds()
+	for y := 0; y < r.Dy(); y++ {
+		for x := 0; x < r.Dx(); x++ {
+			sx := b.Min.X + x*b.Dx()/r.Dx()
+			sy := b.Min.Y + y*b.Dy()/r.Dy()
+			dst.Set(r.Min.X+x, r.Min.Y+y, src.At(sx, sy))
+		}
+	}
+}
+
+// writeContactSheet downloads the covers of the most played albums and
+// composites them, most played first, into a grid×grid PNG of cellSize pixels
+// square thumbnails.
+func writeContactSheet(fileName string, allStreams []endsong.Stream, grid int, cellSize int) {
+	urls := topArtworkURLs(allStreams, grid*grid)
+	sheet := image.NewRGBA(image.Rect(0, 0, grid*cellSize, grid*cellSize))
+
+	bar := newProgressBar(int64(len(urls)))
+	for i, url := range urls {
+		img, err := downloadImage(url)
+		bar.Add(1)
+		if err != nil {
+			printWarning("Couldn't download %s: %v", url, err)
+			continue
+		}
+
+		x, y := i%grid*cellSize, i/grid*cellSize
+		drawScaled(sheet, image.Rect(x, y, x+cellSize, y+cellSize), img)
+	}
+
+	err := writeFileAtomically(fileName, func(w io.Writer) error {
+		return png.Encode(w, sheet)
+	})
+	if err != nil {
+		fatal("Error when writing image: ", err)
+	}
+	printDone("%s written!", fileName)
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+// defaultArtworkDir is the folder artwork images are downloaded to, unless
+// set by -download-dir.
+const defaultArtworkDir = "artwork"
+
+// manifestFileName is the file listing the downloaded images, in the download
+// folder.
+const manifestFileName = "manifest.json"
+
+// manifestEntry is the downloaded image of a track.
+type manifestEntry struct {
+	ArtworkURL string `json:"artwork_url"`
+	Path       string `json:"path"`
+}
+
+// openURL GETs url and returns its body, failing on non-200 responses.
+func openURL(url string) (io.ReadCloser, error) {
+	resp, err := http.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected HTTP status %s", resp.Status)
+	}
+	return resp.Body, nil
+}
+
+// downloadFile saves the content at url to path and returns its size.
+func downloadFile(url string, path string) (int64, error) {
+	body, err := openURL(url)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	return writeFileFrom(path, body)
+}
+
+func copyFile(src string, dst string) error {
+	f, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = writeFileFrom(dst, f)
+	return err
+}
+
+// writeFileFrom writes r to path through a temporary file, so an interrupted
+// write never leaves a truncated image behind.
+func writeFileFrom(path string, r io.Reader) (int64, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return 0, err
+	}
+	var n int64
+	err := writeFileAtomically(path, func(w io.Writer) error {
+		var err error
+		n, err = io.Copy(w, r)
+		return err
+	})
+	return n, err
+}
+
+// sanitizeFileName replaces characters that are illegal in file names on
+// common filesystems, and trims the trailing dots and spaces Windows rejects.
+func sanitizeFileName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 0x20 || strings.ContainsRune(`<>:"/\|?*`, r) {
+			return '_'
+		}
+		return r
+	}, name)
+	name = strings.TrimRight(strings.TrimSpace(name), ". ")
+	if name == "" || name == "." || name == ".." {
+		return "_"
+	}
+	return name
+}
+
+// artistDirNames maps each artist to a distinct folder name. Artists whose
+// sanitized names collide (e.g. "AC/DC" and "AC:DC", or names only differing
+// in case) get a numbered suffix, in artist name order.
+func artistDirNames(artists []string) map[string]string {
+	sort.Strings(artists)
+
+	dirNames := make(map[string]string)
+	taken := make(map[string]bool)
+	for _, artist := range artists {
+		if _, ok := dirNames[artist]; ok {
+			continue
+		}
+
+		base := artist
+		if base == "" {
+			base = "Unknown Artist"
+		}
+		base = sanitizeFileName(base)
+
+		dirName := base
+		for n := 2; taken[strings.ToLower(dirName)]; n++ {
+			dirName = fmt.Sprintf("%s (%d)", base, n)
+		}
+		taken[strings.ToLower(dirName)] = true
+		dirNames[artist] = dirName
+	}
+	return dirNames
+}
+
+// downloadJob is an artwork image to download once, and save to the paths of
+// every track using it.
+type downloadJob struct {
+	url   string
+	paths []string
+}
+
+// downloadArtworks downloads the artwork of each track as
+// <dir>/<trackID>.jpg, or <dir>/<artist>/<trackID>.jpg when byArtist is set,
+// using concurrency workers. Each image is downloaded once and copied to the
+// other tracks of the same album. Images already present are skipped, and
+// failed downloads are logged without aborting.
+//
+// The images present once done are listed in <dir>/manifest.json, and their
+// paths are returned keyed by track ID.
+func downloadArtworks(allStreams []endsong.Stream, artworkByID map[string]endsong.Artwork, dir string, byArtist bool, concurrency int) map[string]string {
+	artistByID := make(map[string]string)
+	var artists []string
+	for _, s := range allStreams {
+		trackID, _ := endsong.TrackIDFromURI(s.SpotifyTrackURI)
+		if _, ok := artworkByID[trackID]; !ok {
+			continue
+		}
+		if _, ok := artistByID[trackID]; !ok {
+			artistByID[trackID] = s.MasterMetadataAlbumArtistName
+			artists = append(artists, s.MasterMetadataAlbumArtistName)
+		}
+	}
+	dirNames := artistDirNames(artists)
+
+	trackIDs := make([]string, 0, len(artistByID))
+	for trackID := range artistByID {
+		trackIDs = append(trackIDs, trackID)
+	}
+	sort.Strings(trackIDs)
+
+	// Group the missing images by URL
+	var jobs []*downloadJob
+	jobByURL := make(map[string]*downloadJob)
+	pathCount := 0
+	pathByID := make(map[string]string)
+	for _, trackID := range trackIDs {
+		path := filepath.Join(dir, trackID+".jpg")
+		if byArtist {
+			path = filepath.Join(dir, dirNames[artistByID[trackID]], trackID+".jpg")
+		}
+		pathByID[trackID] = path
+		if _, err := os.Stat(path); err == nil {
+			continue
+		}
+
+		url := artworkByID[trackID].URL
+		job, ok := jobByURL[url]
+		if !ok {
+			job = &downloadJob{url: url}
+			jobs = append(jobs, job)
+			jobByURL[url] = job
+		}
+		job.paths = append(job.paths, path)
+		pathCount++
+	}
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	var downloaded, downloadedBytes int64
+	bar := newProgressBar(int64(pathCount))
+	jobsCh := make(chan *downloadJob)
+	var wg sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range jobsCh {
+				n, err := downloadFile(job.url, job.paths[0])
+				if err != nil {
+					printWarning("Couldn't download %s: %v", job.url, err)
+					bar.Add(len(job.paths))
+					continue
+				}
+				atomic.AddInt64(&downloadedBytes, n)
+				atomic.AddInt64(&downloaded, 1)
+
+				for _, path := range job.paths[1:] {
+					if err := copyFile(job.paths[0], path); err != nil {
+						printWarning("Couldn't copy %s to %s: %v", job.paths[0], path, err)
+					}
+				}
+				bar.Add(len(job.paths))
+			}
+		}()
+	}
+	for _, job := range jobs {
+		jobsCh <- job
+	}
+	close(jobsCh)
+	wg.Wait()
+
+	printDone("%d artworks downloaded (%.1f MB)!", downloaded, float64(downloadedBytes)/(1<<20))
+
+	// List the images present, leaving out failed downloads
+	manifest := make(map[string]manifestEntry)
+	for trackID, path := range pathByID {
+		if _, err := os.Stat(path); err != nil {
+			delete(pathByID, trackID)
+			continue
+		}
+		manifest[trackID] = manifestEntry{ArtworkURL: artworkByID[trackID].URL, Path: path}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fatal("Error when creating directory: ", err)
+	}
+	writeJSONFile(filepath.Join(dir, manifestFileName), manifest)
+
+	return pathByID
+}
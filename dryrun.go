@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+// uriCounts is the number of streams of each kind of URI, as classified
+// before fetching artwork.
+type uriCounts struct {
+	Tracks         int
+	UniqueTracks   int
+	Episodes       int
+	UniqueEpisodes int
+	Local          int
+	Invalid        int
+	// AlreadySet is the number of streams that already have artwork, which
+	// aren't looked up unless they lack metadata with -enrich-metadata.
+	AlreadySet int
+}
+
+// countURIs classifies the streams by URI the way endsong.AddArtworks does.
+func countURIs(allStreams []endsong.Stream) uriCounts {
+	var counts uriCounts
+	trackIDs := make(map[string]bool)
+	episodeIDs := make(map[string]bool)
+	for _, s := range allStreams {
+		episodeID, isEpisode := endsong.EpisodeIDFromURI(s.SpotifyEpisodeURI)
+		if s.HasArtwork() {
+			counts.AlreadySet++
+			if !*enrichMetadata || isEpisode || s.TrackDurationMS != nil {
+				continue
+			}
+		}
+
+		if isEpisode {
+			counts.Episodes++
+			episodeIDs[episodeID] = true
+			continue
+		}
+
+		if trackID, ok := endsong.TrackIDFromURI(s.SpotifyTrackURI); ok {
+			counts.Tracks++
+			trackIDs[trackID] = true
+			continue
+		}
+		switch {
+		case endsong.IsLocalURI(s.SpotifyTrackURI):
+			counts.Local++
+		default:
+			counts.Invalid++
+		}
+	}
+	counts.UniqueTracks = len(trackIDs)
+	counts.UniqueEpisodes = len(episodeIDs)
+
+	return counts
+}
+
+// printDryRun prints what a run would fetch, without calling the API.
+func printDryRun(allStreams []endsong.Stream) {
+	counts := countURIs(allStreams)
+	w := reportOutput()
+	fmt.Fprintf(w, "%d track streams, %d unique tracks.\n", counts.Tracks, counts.UniqueTracks)
+	fmt.Fprintf(w, "%d episode streams, %d unique episodes.\n", counts.Episodes, counts.UniqueEpisodes)
+	fmt.Fprintf(w, "%d local file streams and %d streams without a valid URI will be skipped.\n", counts.Local, counts.Invalid)
+	if counts.AlreadySet > 0 {
+		fmt.Fprintf(w, "%d streams already have artwork, kept as is.\n", counts.AlreadySet)
+	}
+
+	requests := (counts.UniqueTracks+endsong.MaxTracksPerRequest-1)/endsong.MaxTracksPerRequest + counts.UniqueEpisodes
+	printDone("Dry run: up to %d API requests, none sent.", requests)
+}
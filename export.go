@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/csv"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+// writeArtworkCSV writes the track ID to artwork mapping, one row per track.
+func writeArtworkCSV(fileName string, artworkByID map[string]endsong.Artwork) {
+	trackIDs := make([]string, 0, len(artworkByID))
+	for trackID := range artworkByID {
+		trackIDs = append(trackIDs, trackID)
+	}
+	sort.Strings(trackIDs)
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		fatal("Error when creating file: ", err)
+	}
+	defer f.Close()
+
+	w := csv.NewWriter(f)
+	w.Write([]string{"track_id", "album_id", "artwork_url"})
+	for _, trackID := range trackIDs {
+		artwork := artworkByID[trackID]
+		w.Write([]string{trackID, artwork.AlbumID, artwork.URL})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		fatal("Error when writing CSV file: ", err)
+	}
+	printDone("%s written!", fileName)
+}
+
+// streamCSVHeader is the header of the streams CSV file, named after the JSON
+// fields.
+var streamCSVHeader = []string{
+	"ts",
+	"master_metadata_track_name",
+	"master_metadata_album_artist_name",
+	"master_metadata_album_album_name",
+	"ms_played",
+	"reason_start",
+	"reason_end",
+	"skipped",
+	"artwork_url",
+}
+
+// writeStreamsCSV writes the streams to fileName, one row per stream. Unknown
+// values such as a null skipped are left empty.
+func writeStreamsCSV(fileName string, allStreams []endsong.Stream) {
+	err := writeFileAtomically(fileName, func(f io.Writer) error {
+		return encodeStreamsCSV(f, allStreams)
+	})
+	if err != nil {
+		fatal("Error when writing CSV file: ", err)
+	}
+}
+
+// encodeStreamsCSV writes the streams to f as CSV, with a header row.
+func encodeStreamsCSV(f io.Writer, allStreams []endsong.Stream) error {
+	header := append([]string(nil), streamCSVHeader...)
+	for i, column := range header {
+		if column == endsong.ArtworkField {
+			header[i] = *artworkField
+		}
+	}
+
+	w := csv.NewWriter(f)
+	w.Write(header)
+	for _, s := range allStreams {
+		var skipped, artworkURL string
+		if s.Skipped != nil {
+			skipped = strconv.FormatBool(*s.Skipped)
+		}
+		if s.ArtworkURL != nil {
+			artworkURL = *s.ArtworkURL
+		}
+		w.Write([]string{
+			s.Ts.Format(time.RFC3339),
+			s.MasterMetadataTrackName,
+			s.MasterMetadataAlbumArtistName,
+			s.MasterMetadataAlbumAlbumName,
+			strconv.FormatInt(s.MSPlayed, 10),
+			string(s.ReasonStart),
+			string(s.ReasonEnd),
+			skipped,
+			artworkURL,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
@@ -1,12 +1,13 @@
 module github.com/imkh/spotify-endsong-artwork
 
-go 1.19
+go 1.21
 
 require (
 	github.com/joho/godotenv v1.4.0
 	github.com/schollz/progressbar/v3 v3.13.0
-	github.com/zmb3/spotify/v2 v2.3.1
+	github.com/zmb3/spotify/v2 v2.4.3
 	golang.org/x/oauth2 v0.4.0
+	golang.org/x/term v0.18.0
 )
 
 require (
@@ -14,9 +15,8 @@ require (
 	github.com/mattn/go-runewidth v0.0.14 // indirect
 	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
 	github.com/rivo/uniseg v0.4.3 // indirect
-	golang.org/x/net v0.5.0 // indirect
-	golang.org/x/sys v0.4.0 // indirect
-	golang.org/x/term v0.4.0 // indirect
+	golang.org/x/net v0.23.0 // indirect
+	golang.org/x/sys v0.18.0 // indirect
 	google.golang.org/appengine v1.6.7 // indirect
-	google.golang.org/protobuf v1.28.1 // indirect
+	google.golang.org/protobuf v1.33.0 // indirect
 )
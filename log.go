@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+)
+
+// levelDone is the level of success messages, above info so that they stand
+// out in green, and below warnings so that -quiet hides them with the rest of
+// the chatter.
+const levelDone = slog.LevelInfo + 2
+
+// logLevel is the minimum level of the messages printed, set by setupLogging.
+var logLevel = new(slog.LevelVar)
+
+// messagesToStderr sends all messages and reports to stderr, set when the
+// streams are written to stdout so that it only holds them.
+var messagesToStderr bool
+
+// messageOutput returns where messages below errors and reports are printed,
+// and whether they can be colored.
+func messageOutput() (io.Writer, bool) {
+	if messagesToStderr {
+		return os.Stderr, stderrColor
+	}
+	return os.Stdout, stdoutColor
+}
+
+// reportOutput returns where reports such as -file-stats are printed.
+func reportOutput() io.Writer {
+	w, _ := messageOutput()
+	return w
+}
+
+// logger prints the messages of the command.
+var logger = slog.New(&cliHandler{level: logLevel, mu: new(sync.Mutex)})
+
+// setupLogging sets the level of the printed messages: debug messages with
+// -verbose, and only warnings and errors with -quiet.
+func setupLogging(verbose, quiet bool) {
+	switch {
+	case verbose && quiet:
+		fatal("-verbose and -quiet can't be used together")
+	case verbose:
+		logLevel.Set(slog.LevelDebug)
+	case quiet:
+		logLevel.Set(slog.LevelWarn)
+	}
+}
+
+// cliHandler is a slog.Handler printing one plain line per message, followed
+// by its attributes if any, colored according to its level when enabled.
+// Errors go to stderr and the rest to stdout.
+type cliHandler struct {
+	level *slog.LevelVar
+	attrs []slog.Attr
+	mu    *sync.Mutex
+}
+
+func (h *cliHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *cliHandler) Handle(_ context.Context, r slog.Record) error {
+	var b strings.Builder
+	b.WriteString(r.Message)
+	writeAttr := func(a slog.Attr) bool {
+		fmt.Fprintf(&b, " %s=%v", a.Key, a.Value)
+		return true
+	}
+	for _, a := range h.attrs {
+		writeAttr(a)
+	}
+	r.Attrs(writeAttr)
+
+	w, enabled := messageOutput()
+	color := ""
+	switch {
+	case r.Level >= slog.LevelError:
+		w, color, enabled = os.Stderr, colorRed, stderrColor
+	case r.Level >= slog.LevelWarn:
+		color = colorYellow
+	case r.Level >= levelDone:
+		color = colorGreen
+	}
+	line := b.String()
+	if color != "" {
+		line = colorize(color, line, enabled)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := fmt.Fprintln(w, line)
+	return err
+}
+
+func (h *cliHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &cliHandler{level: h.level, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...), mu: h.mu}
+}
+
+// WithGroup doesn't qualify the attributes, as none of the messages use
+// groups.
+func (h *cliHandler) WithGroup(string) slog.Handler {
+	return h
+}
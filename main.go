@@ -2,191 +2,983 @@ package main
 
 import (
 	"context"
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
+	"io"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
 	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
 	"github.com/joho/godotenv"
-	"github.com/schollz/progressbar/v3"
 	"github.com/zmb3/spotify/v2"
 	spotifyauth "github.com/zmb3/spotify/v2/auth"
+	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/clientcredentials"
 )
 
-type Stream struct {
-	Ts                            time.Time   `json:"ts"`
-	Username                      string      `json:"username"`
-	Platform                      string      `json:"platform"`
-	MSPlayed                      int64       `json:"ms_played"`
-	ConnCountry                   string      `json:"conn_country"`
-	IPAddrDecrypted               string      `json:"ip_addr_decrypted"`
-	UserAgentDecrypted            *string     `json:"user_agent_decrypted"`
-	MasterMetadataTrackName       string      `json:"master_metadata_track_name"`
-	MasterMetadataAlbumArtistName string      `json:"master_metadata_album_artist_name"`
-	MasterMetadataAlbumAlbumName  string      `json:"master_metadata_album_album_name"`
-	SpotifyTrackURI               string      `json:"spotify_track_uri"`
-	EpisodeName                   *string     `json:"episode_name"`
-	EpisodeShowName               *string     `json:"episode_show_name"`
-	SpotifyEpisodeURI             *string     `json:"spotify_episode_uri"`
-	ReasonStart                   ReasonStart `json:"reason_start"`
-	ReasonEnd                     ReasonEnd   `json:"reason_end"`
-	Shuffle                       bool        `json:"shuffle"`
-	Skipped                       *bool       `json:"skipped"`
-	Offline                       bool        `json:"offline"`
-	OfflineTimestamp              int64       `json:"offline_timestamp"`
-	IncognitoMode                 bool        `json:"incognito_mode"`
-
-	ArtworkURL *string `json:"artwork_url"`
-}
-
-type ReasonStart string
-
-const (
-	Appload               ReasonStart = "appload"
-	Clickrow              ReasonStart = "clickrow"
-	Playbtn               ReasonStart = "playbtn"
-	ReasonStartBackbtn    ReasonStart = "backbtn"
-	ReasonStartFwdbtn     ReasonStart = "fwdbtn"
-	ReasonStartRemote     ReasonStart = "remote"
-	ReasonStartTrackdone  ReasonStart = "trackdone"
-	ReasonStartTrackerror ReasonStart = "trackerror"
+var (
+	exportHeatmap           = flag.Bool("export-heatmap", false, "write a weekday/hour listening heatmap to heatmap.json")
+	exportArtistTrends      = flag.Bool("export-artist-trends", false, "write monthly listening time of the top artists to artist_trends.json")
+	artistTrendsTop         = flag.Int("artist-trends-top", 10, "number of artists in artist trends, the rest are bucketed as \"Other\"")
+	noSort                  = flag.Bool("no-sort", false, "skip sorting streams by timestamp and keep read order")
+	exportArtworkCSV        = flag.Bool("export-artwork-csv", false, "write the track ID to artwork URL mapping to artwork.csv")
+	progressWidth           = flag.Int("progress-width", 0, "progress bar width in characters (default full terminal width)")
+	progressTheme           = flag.String("progress-theme", "unicode", "progress bar theme: unicode or ascii")
+	addIDs                  = flag.Bool("add-ids", false, "add a stable stream_id hash to each stream")
+	offlineTimeout          = flag.Duration("offline-timeout", 10*time.Minute, "give up when the network stays unreachable for this long")
+	exportContactSheet      = flag.Bool("export-contact-sheet", false, "write a grid of the most played album covers to contact_sheet.png")
+	contactSheetGrid        = flag.Int("contact-sheet-grid", 10, "number of covers per row and column of the contact sheet")
+	contactSheetCell        = flag.Int("contact-sheet-cell", 64, "size in pixels of each contact sheet cover")
+	splitByPlatform         = flag.Bool("split-by-platform", false, "write one streams_<platform>.json file per normalized platform")
+	sessionGap              = flag.Duration("session-gap", 30*time.Minute, "start a new listening session after a gap longer than this")
+	artworkPercentile       = flag.Float64("artwork-percentile", 0, "only fetch artwork for tracks whose total playtime is at or above this percentile (0 to 1)")
+	outputFormat            = flag.String("format", "json", "output format: json, ndjson, csv, or prometheus for listening metrics instead of streams")
+	prometheusTop           = flag.Int("prometheus-top", 10, "number of artists labeled in prometheus metrics")
+	streamsCacheFile        = flag.String("streams-cache", ".streams_cache.json", "cache of the merged input streams, reused while input files are unchanged (empty to disable)")
+	changedOnly             = flag.Bool("changed-only", false, "write the streams that got artwork fetched during this run to changed.json")
+	fieldsList              = flag.String("fields", "", "comma separated list of the only stream fields to write (default all)")
+	metadataFile            = flag.String("metadata-file", "", "JSON file mapping track IDs to their artwork, used instead of the Spotify API")
+	downloadArtwork         = flag.Bool("download-artwork", false, "download artwork images to artwork/<trackID>.jpg")
+	artworkByArtist         = flag.Bool("artwork-by-artist", false, "download artwork images to artwork/<artist>/<trackID>.jpg")
+	exportSummary           = flag.Bool("export-summary", false, "print listening by release decade and write it to summary.json")
+	validateCredentialsOnly = flag.Bool("validate-credentials-only", false, "only check that the Spotify credentials work, then exit")
+	lenient                 = flag.Bool("lenient", false, "skip malformed records in input files instead of failing")
+	emitEmptyArtworkField   = flag.Bool("emit-empty-artwork-field", false, "write an empty artwork_url instead of null for streams without artwork")
+	downloadConcurrency     = flag.Int("download-concurrency", 8, "number of parallel artwork image downloads")
+	fileStats               = flag.Bool("file-stats", false, "print the streams and listening time contributed by each input file")
+	workers                 = flag.Int("workers", defaultWorkers(), "number of concurrent track lookups, also set by the WORKERS environment variable")
+	noCache                 = flag.Bool("no-cache", false, "don't load nor save the artwork and streams caches")
+	imageSize               = flag.String("image-size", "large", "artwork resolution: small (64px), medium (300px) or large (640px)")
+	inputDir                = flag.String("input-dir", ".", "directory or zip archive to read the streaming history files from")
+	output                  = flag.String("output", "", "path of the output streams file (default sorted_streams.json, or sorted_streams.csv with -format=csv)")
+	maxRetries              = flag.Int("max-retries", 5, "maximum number of retries of a request rate limited by Spotify")
+	dryRun                  = flag.Bool("dry-run", false, "only read the streams and print what would be fetched, without calling the Spotify API or writing files")
+	dedupe                  = flag.Bool("dedupe", false, "remove streams with the same timestamp, URI and ms played as another")
+	pattern                 = flag.String("pattern", "", "glob of the input file or zip entry names, e.g. my_history_*.json (default endsong_*.json and Streaming_History_Audio_*.json)")
+	verbose                 = flag.Bool("verbose", false, "also print debug messages")
+	quiet                   = flag.Bool("quiet", false, "only print warnings and errors, without progress bars")
+	exportStats             = flag.Bool("stats", false, "write a listening summary (total time, top artists and tracks, date range) to stats.json")
+	minMS                   = flag.Int64("min-ms", 0, "drop streams played for less than this many ms before fetching artwork")
+	limit                   = flag.Int("limit", 0, "only process the first N streams, after sorting and filtering (0 for all)")
+	downloadDir             = flag.String("download-dir", "", "download artwork images to this folder (default artwork with -download-artwork)")
+	localArtworkPaths       = flag.Bool("local-artwork-paths", false, "write the path of the downloaded image as artwork_url instead of its URL")
+	mergeFile               = flag.String("merge", "", "previous output JSON `file` to merge the new streams into, keeping its streams and artwork")
+	sortOrder               = flag.String("sort", "ts-asc", "order of the written streams: ts-asc, ts-desc, none (read order) or duration (shortest ms_played first)")
+	username                = flag.String("username", "", "only process the streams of this account username (default all)")
+	since                   = flag.String("since", "", "only process the streams from this date on, as RFC3339 or YYYY-MM-DD (inclusive)")
+	until                   = flag.String("until", "", "only process the streams up to this date, as RFC3339 or YYYY-MM-DD (inclusive)")
+	requestTimeout          = flag.Duration("timeout", 30*time.Second, "timeout of each Spotify API request (0 for none)")
+	enrichMetadata          = flag.Bool("enrich-metadata", false, "add the duration, popularity, explicit flag, album release date and track and disc numbers of tracks to the streams")
+	failFast                = flag.Bool("fail-fast", false, "exit at the first failed API request or unresolved track instead of skipping what it would have resolved")
+	artworkField            = flag.String("artwork-field", "artwork_url", "key the artwork URL is written under, e.g. image")
+	market                  = flag.String("market", "", "ISO 3166-1 alpha-2 country code tracks and episodes are looked up in, e.g. FR")
+	splitBy                 = flag.String("split-by", "", "write one file per group of streams instead: year, or platform like -split-by-platform")
+	compact                 = flag.Bool("compact", false, "write the JSON streams file without indentation")
+	reportSkipped           = flag.String("report-skipped", "", "write the streams left without artwork to this JSON file, with the reason of each")
+	pruneCache              = flag.Bool("prune-cache", false, "drop the cached artworks of the tracks and episodes no input stream references")
+	colorMode               = flag.String("color", "auto", "color terminal messages: auto, always or never")
 )
 
-type ReasonEnd string
-
-const (
-	Endplay                   ReasonEnd = "endplay"
-	Logout                    ReasonEnd = "logout"
-	ReasonEndBackbtn          ReasonEnd = "backbtn"
-	ReasonEndFwdbtn           ReasonEnd = "fwdbtn"
-	ReasonEndRemote           ReasonEnd = "remote"
-	ReasonEndTrackdone        ReasonEnd = "trackdone"
-	ReasonEndTrackerror       ReasonEnd = "trackerror"
-	UnexpectedExit            ReasonEnd = "unexpected-exit"
-	UnexpectedExitWhilePaused ReasonEnd = "unexpected-exit-while-paused"
-	Unknown                   ReasonEnd = "unknown"
-)
+// defaultWorkers is the number of concurrent lookups, unless overridden with
+// -workers or the WORKERS environment variable.
+func defaultWorkers() int {
+	if n, err := strconv.Atoi(os.Getenv("WORKERS")); err == nil && n > 0 {
+		return n
+	}
+	return 4
+}
 
-func prettyPrint(i interface{}) {
-	s, _ := json.MarshalIndent(i, "", "\t")
-	fmt.Println(string(s))
+// addGapsFromPrevious sets the gap between the end of each stream and the
+// start of the next one, for sorted streams. The first stream's gap is zero.
+func addGapsFromPrevious(allStreams []endsong.Stream) {
+	for i := range allStreams {
+		var gap int64
+		if i > 0 {
+			prev := allStreams[i-1]
+			gap = allStreams[i].Ts.Sub(prev.Ts).Milliseconds() - prev.MSPlayed
+		}
+		allStreams[i].GapFromPreviousMS = &gap
+	}
 }
 
-func readEndsongFiles() []Stream {
-	var allStreams []Stream
+// sortStreams reorders streams sorted by timestamp for -sort: newest first
+// with ts-desc, or by ms played with duration, ties keeping their order. Other
+// orders are left as is.
+func sortStreams(allStreams []endsong.Stream, order string) {
+	switch order {
+	case "ts-desc":
+		sort.SliceStable(allStreams, func(i, j int) bool {
+			return allStreams[i].Ts.After(allStreams[j].Ts)
+		})
+	case "duration":
+		sort.SliceStable(allStreams, func(i, j int) bool {
+			return allStreams[i].MSPlayed < allStreams[j].MSPlayed
+		})
+	}
+}
 
-	files, err := ioutil.ReadDir(".")
-	if err != nil {
-		log.Fatal("Error while reading directory", err)
+// streamID returns a stable identifier for s: the hex SHA-1 of its
+// timestamp, URI and ms played.
+func streamID(s endsong.Stream) string {
+	uri := s.SpotifyTrackURI
+	if uri == "" && s.SpotifyEpisodeURI != nil {
+		uri = *s.SpotifyEpisodeURI
 	}
+	sum := sha1.Sum([]byte(fmt.Sprintf("%s|%s|%d", s.Ts.UTC().Format(time.RFC3339Nano), uri, s.MSPlayed)))
+	return hex.EncodeToString(sum[:])
+}
 
-	for _, f := range files {
-		fileName := f.Name()
-		if !strings.HasSuffix(fileName, ".json") {
+// dedupeStreams removes the streams with the same timestamp, URI and ms played
+// as an earlier one, and returns how many were removed.
+func dedupeStreams(allStreams []endsong.Stream) ([]endsong.Stream, int) {
+	seen := make(map[string]bool)
+	deduped := allStreams[:0]
+	for _, s := range allStreams {
+		id := streamID(s)
+		if seen[id] {
 			continue
 		}
+		seen[id] = true
+		deduped = append(deduped, s)
+	}
+	return deduped, len(allStreams) - len(deduped)
+}
 
-		if strings.HasPrefix(fileName, "endsong_") || strings.HasPrefix(fileName, "Streaming_History_Audio_") {
-			var fileStreams []Stream
+// filterMinMS removes the streams played for less than minMS, and returns how
+// many were removed.
+func filterMinMS(allStreams []endsong.Stream, minMS int64) ([]endsong.Stream, int) {
+	kept := allStreams[:0]
+	for _, s := range allStreams {
+		if s.MSPlayed >= minMS {
+			kept = append(kept, s)
+		}
+	}
+	return kept, len(allStreams) - len(kept)
+}
 
-			content, err := ioutil.ReadFile(fileName)
-			if err != nil {
-				log.Fatal("Error when opening file: ", err)
-			}
+// distinctUsernames returns the account usernames of the streams, sorted.
+// Streams without one are left out.
+func distinctUsernames(allStreams []endsong.Stream) []string {
+	seen := make(map[string]bool)
+	var usernames []string
+	for _, s := range allStreams {
+		if s.Username != "" && !seen[s.Username] {
+			seen[s.Username] = true
+			usernames = append(usernames, s.Username)
+		}
+	}
+	sort.Strings(usernames)
+	return usernames
+}
 
-			err = json.Unmarshal(content, &fileStreams)
-			if err != nil {
-				log.Fatal("Error during Unmarshal(): ", err)
-			}
+// filterUsername removes the streams of other accounts than username, and
+// returns how many were removed.
+func filterUsername(allStreams []endsong.Stream, username string) ([]endsong.Stream, int) {
+	kept := allStreams[:0]
+	for _, s := range allStreams {
+		if s.Username == username {
+			kept = append(kept, s)
+		}
+	}
+	return kept, len(allStreams) - len(kept)
+}
 
-			allStreams = append(allStreams, fileStreams...)
+// parseDate parses an RFC3339 timestamp or a YYYY-MM-DD date in UTC. end is
+// the first instant after it: the next nanosecond, or the next day for a date.
+func parseDate(value string) (t, end time.Time, err error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, t.Add(time.Nanosecond), nil
+	}
+	t, err = time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, time.Time{}, errors.New("must be an RFC3339 timestamp or a YYYY-MM-DD date")
+	}
+	return t, t.AddDate(0, 0, 1), nil
+}
 
-			fmt.Printf("%s done!\n", fileName)
+// filterDateRange removes the streams before since or from until on, where
+// a zero bound is open, and returns how many were removed.
+func filterDateRange(allStreams []endsong.Stream, since, until time.Time) ([]endsong.Stream, int) {
+	kept := allStreams[:0]
+	for _, s := range allStreams {
+		if (since.IsZero() || !s.Ts.Before(since)) && (until.IsZero() || s.Ts.Before(until)) {
+			kept = append(kept, s)
 		}
 	}
+	return kept, len(allStreams) - len(kept)
+}
+
+func prettyPrint(i interface{}) {
+	s, _ := json.MarshalIndent(i, "", "\t")
+	fmt.Fprintln(reportOutput(), string(s))
+}
+
+// isStdout reports whether fileName stands for the standard output.
+func isStdout(fileName string) bool {
+	return fileName == "-" || fileName == "/dev/stdout"
+}
+
+// checkInputDir exits unless dir is a readable directory or a zip archive.
+func checkInputDir(dir string) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		fatalf("invalid -input-dir %q: %v", dir, err)
+	}
+	if !info.IsDir() && endsong.IsZip(dir) {
+		return
+	}
+	if !info.IsDir() {
+		fatalf("invalid -input-dir %q: not a directory", dir)
+	}
+	f, err := os.Open(dir)
+	if err != nil {
+		fatalf("invalid -input-dir %q: %v", dir, err)
+	}
+	defer f.Close()
+	if _, err := f.Readdirnames(1); err != nil && err != io.EOF {
+		fatalf("invalid -input-dir %q: %v", dir, err)
+	}
+}
+
+// spotifyCredentialPattern matches Spotify client IDs and secrets, which are
+// 32 lowercase hex characters.
+var spotifyCredentialPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
 
-	return allStreams
+// validateCredential rejects empty, placeholder ("your_client_id") and
+// malformed credentials before they're sent to the token endpoint.
+func validateCredential(name, value string) error {
+	switch {
+	case value == "":
+		return fmt.Errorf("%s is empty", name)
+	case strings.Contains(strings.ToLower(value), "your_"):
+		return fmt.Errorf("%s is still a placeholder value (%q)", name, value)
+	case !spotifyCredentialPattern.MatchString(value):
+		return fmt.Errorf("%s doesn't look like a Spotify credential (expected 32 hex characters)", name)
+	}
+	return nil
 }
 
-func addStreamArtworks(allStreams []Stream) []Stream {
+// checkCredentials loads .env and exits with a message naming the variable at
+// fault unless both credentials look valid.
+func checkCredentials() {
 	godotenv.Load()
-	ctx := context.Background()
+	for _, name := range []string{"SPOTIFY_ID", "SPOTIFY_SECRET"} {
+		if err := validateCredential(name, os.Getenv(name)); err != nil {
+			fatalf("invalid credentials: %v. Copy .env.example to .env and fill in the values from your Spotify developer dashboard.", err)
+		}
+	}
+}
+
+// isInvalidClient reports whether err is the invalid_client OAuth error
+// returned by the token endpoint for a wrong client ID or secret.
+func isInvalidClient(err error) bool {
+	var retrieveErr *oauth2.RetrieveError
+	if !errors.As(err, &retrieveErr) {
+		return false
+	}
+	var body struct {
+		Error string `json:"error"`
+	}
+	return json.Unmarshal(retrieveErr.Body, &body) == nil && body.Error == "invalid_client"
+}
+
+// newSpotifyClient returns a client authenticated with the SPOTIFY_ID and
+// SPOTIFY_SECRET client credentials from the environment or .env.
+func newSpotifyClient(ctx context.Context) *spotify.Client {
+	checkCredentials()
+
 	config := &clientcredentials.Config{
 		ClientID:     os.Getenv("SPOTIFY_ID"),
 		ClientSecret: os.Getenv("SPOTIFY_SECRET"),
 		TokenURL:     spotifyauth.TokenURL,
 	}
-	token, err := config.Token(ctx)
+	token, err := getToken(ctx, config)
+	if ctx.Err() != nil {
+		printWarning("Interrupted.")
+		os.Exit(130)
+	}
+	if isInvalidClient(err) {
+		fatalf("couldn't get token: Spotify rejected the client credentials (invalid_client). Check that SPOTIFY_SECRET in .env is the current client secret of the SPOTIFY_ID app in your Spotify developer dashboard, as it changes when the secret is reset.")
+	}
 	if err != nil {
-		log.Fatalf("couldn't get token: %v", err)
+		fatalf("couldn't get token: %v", err)
 	}
+	printDebug("Got a Spotify token, expiring at %s.", token.Expiry.Format(time.RFC3339))
 
-	httpClient := spotifyauth.New().Client(ctx, token)
-	client := spotify.New(httpClient, spotify.WithRetry(true))
+	// The token is renewed from config once expired, for runs outliving it.
+	// Rate limiting is retried by rateLimitTransport rather than WithRetry,
+	// which retries forever without logging.
+	httpClient := oauth2.NewClient(ctx, oauth2.ReuseTokenSource(token, config.TokenSource(ctx)))
+	httpClient.Transport = &rateLimitTransport{base: httpClient.Transport, maxRetries: *maxRetries}
+	return spotify.New(httpClient)
+}
 
-	bar := progressbar.Default(int64(len(allStreams)))
-	artworkByID := make(map[string]string)
-	for i := 0; i < len(allStreams); i++ {
-		splitTrackURI := strings.Split(allStreams[i].SpotifyTrackURI, ":")
-		if splitTrackURI[0] != "spotify" || splitTrackURI[1] != "track" || len(splitTrackURI) < 3 {
-			// log.Printf("SpotifyTrackURI = %q | ts = %q | %q by %q\n", allStreams[i].SpotifyTrackURI, allStreams[i].Ts.Format(time.RFC3339), allStreams[i].MasterMetadataTrackName, allStreams[i].MasterMetadataAlbumArtistName)
-			continue
-		}
+// validationTrackID is a public track fetched to check that the credentials
+// work end to end (the example track of the Spotify Web API reference).
+const validationTrackID = "11dFghVXANMlKmJXsNCbNl"
 
-		trackID := splitTrackURI[2]
+// validateCredentials gets a token and fetches a known track.
+func validateCredentials() {
+	ctx := context.Background()
+	client := newSpotifyClient(ctx)
+	if *requestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, *requestTimeout)
+		defer cancel()
+	}
+	if _, err := client.GetTrack(ctx, validationTrackID); err != nil {
+		fatal("Error when getting Spotify track: ", err)
+	}
+	printDone("credentials OK")
+}
 
-		trackArtwork, ok := artworkByID[trackID]
-		if !ok {
-			track, err := client.GetTrack(ctx, spotify.ID(trackID))
-			if err != nil {
-				log.Fatal("Error when getting Spotify track: ", err)
-			}
-			trackArtwork = track.Album.Images[0].URL
-			artworkByID[trackID] = trackArtwork
+// writeFileAtomically calls write with a temporary file in the directory of
+// fileName, then renames it to fileName once written and closed. A failed or
+// interrupted write thus leaves any previous fileName untouched.
+//
+// Symlinks are followed, so that they're kept. The standard output, as "-" or
+// /dev/stdout, and other files that aren't regular, such as named pipes, are
+// written to directly instead.
+func writeFileAtomically(fileName string, write func(io.Writer) error) error {
+	if isStdout(fileName) {
+		return write(os.Stdout)
+	}
+	if target, err := filepath.EvalSymlinks(fileName); err == nil {
+		fileName = target
+	}
+	if info, err := os.Stat(fileName); err == nil && !info.Mode().IsRegular() {
+		f, err := os.OpenFile(fileName, os.O_WRONLY, 0)
+		if err != nil {
+			return err
 		}
-		allStreams[i].ArtworkURL = &trackArtwork
+		if err := write(f); err != nil {
+			f.Close()
+			return err
+		}
+		return f.Close()
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(fileName), "."+filepath.Base(fileName)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	// CreateTemp makes the file private, unlike os.Create.
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fileName)
+}
+
+// writeSortedFile writes the streams to fileName as a JSON array, or one
+// object per line with -format=ndjson, keeping only the given fields unless
+// fields is empty.
+func writeSortedFile(fileName string, allStreams []endsong.Stream, fields []string) {
+	encode := endsong.WriteJSON
+	if *outputFormat == "ndjson" {
+		encode = endsong.WriteNDJSON
+	}
+	opts := endsong.WriteOptions{Fields: fields, ArtworkField: *artworkField, Compact: *compact}
+	err := writeFileAtomically(fileName, func(w io.Writer) error {
+		return encode(w, allStreams, opts)
+	})
+	if err != nil {
+		fatal("Error when writing file: ", err)
+	}
+}
 
-		bar.Add(1)
+// writeStreamsFile writes the streams to fileName in the -format format.
+func writeStreamsFile(fileName string, allStreams []endsong.Stream, fields []string) {
+	if *outputFormat == "csv" {
+		writeStreamsCSV(fileName, allStreams)
+	} else {
+		writeSortedFile(fileName, allStreams, fields)
 	}
-	fmt.Printf("%d artworks total.\n", len(artworkByID))
+}
+
+// writeSplitFiles writes the streams of each group to their own
+// streams_<group>.json file, or .ndjson or .csv with -format, keeping their
+// relative order. Streams are grouped by normalized platform, or by calendar
+// year in UTC.
+func writeSplitFiles(allStreams []endsong.Stream, fields []string, splitBy string) {
+	groupOf := func(s endsong.Stream) string { return normalizePlatform(s.Platform) }
+	if splitBy == "year" {
+		groupOf = func(s endsong.Stream) string { return strconv.Itoa(s.Ts.UTC().Year()) }
+	}
+
+	var groups []string
+	streamsByGroup := make(map[string][]endsong.Stream)
+	for _, s := range allStreams {
+		group := groupOf(s)
+		if _, ok := streamsByGroup[group]; !ok {
+			groups = append(groups, group)
+		}
+		streamsByGroup[group] = append(streamsByGroup[group], s)
+	}
+	sort.Strings(groups)
 
-	return allStreams
+	for _, group := range groups {
+		fileName := fmt.Sprintf("streams_%s.%s", group, *outputFormat)
+		writeStreamsFile(fileName, streamsByGroup[group], fields)
+		printDone("%s: %d streams sorted!", fileName, len(streamsByGroup[group]))
+	}
 }
 
-func writeSortedFile(allStreams []Stream) {
-	sortedFile, _ := os.Create("sorted_streams.json")
-	defer sortedFile.Close()
-	enc := json.NewEncoder(sortedFile)
+func writeJSONFile(fileName string, v interface{}) {
+	f, err := os.Create(fileName)
+	if err != nil {
+		fatal("Error when creating file: ", err)
+	}
+	defer f.Close()
+	enc := json.NewEncoder(f)
 	enc.SetEscapeHTML(false)
 	enc.SetIndent("", "    ")
-	if err := enc.Encode(allStreams); err != nil {
-		log.Fatal("Error when encoding file: ", err)
+	if err := enc.Encode(v); err != nil {
+		fatal("Error when encoding file: ", err)
 	}
-	fmt.Printf("%d streams sorted!\n", len(allStreams))
+	printDone("%s written!", fileName)
 }
 
 func main() {
-	// Read unsorted streams files
-	allStreams := readEndsongFiles()
+	flag.Parse()
+	setupColor(*colorMode)
+	setupLogging(*verbose, *quiet)
+	messagesToStderr = isStdout(*output)
+	if *outputFormat != "json" && *outputFormat != "ndjson" && *outputFormat != "csv" && *outputFormat != "prometheus" {
+		fatalf("invalid -format value %q: must be json, ndjson, csv or prometheus", *outputFormat)
+	}
+	fields, err := endsong.ParseFields(*fieldsList)
+	if err != nil {
+		fatalf("invalid -fields value: %v", err)
+	}
+	if *artistTrendsTop < 1 {
+		fatalf("invalid -artist-trends-top value %d: must be at least 1", *artistTrendsTop)
+	}
+	if *pruneCache && *noCache {
+		fatal("-prune-cache can't be used with -no-cache")
+	}
+	if *contactSheetGrid < 1 {
+		fatalf("invalid -contact-sheet-grid value %d: must be at least 1", *contactSheetGrid)
+	}
+	if *contactSheetCell < 1 {
+		fatalf("invalid -contact-sheet-cell value %d: must be at least 1", *contactSheetCell)
+	}
+	if *prometheusTop < 1 {
+		fatalf("invalid -prometheus-top value %d: must be at least 1", *prometheusTop)
+	}
+	if *outputFormat == "prometheus" && (*exportArtworkCSV || *exportSummary || *changedOnly || *reportSkipped != "" ||
+		*downloadArtwork || *artworkByArtist || *downloadDir != "" || *exportContactSheet || *pruneCache) {
+		fatal("-format=prometheus doesn't fetch artworks, so it can't be used with the options that need them")
+	}
+	if *compact && *outputFormat != "json" {
+		fatalf("-compact can't be used with -format=%s, only with -format=json", *outputFormat)
+	}
+	if len(fields) > 0 && *outputFormat == "csv" {
+		fatal("-fields can't be used with -format=csv, which has fixed columns")
+	}
+	if *artworkField == "" {
+		fatal("invalid -artwork-field value: must not be empty")
+	}
+	for _, name := range endsong.StreamFieldNames() {
+		if *artworkField == name && name != endsong.ArtworkField {
+			fatalf("invalid -artwork-field value %q: already the name of another field", *artworkField)
+		}
+	}
+	if *market != "" {
+		if !isCountryCode(*market) {
+			fatalf("invalid -market value %q: must be a two-letter ISO 3166-1 country code, e.g. FR", *market)
+		}
+		*market = strings.ToUpper(*market)
+	}
+	if *artworkPercentile < 0 || *artworkPercentile > 1 {
+		fatalf("invalid -artwork-percentile value %v: must be between 0 and 1", *artworkPercentile)
+	}
+	if *progressTheme != "unicode" && *progressTheme != "ascii" {
+		fatalf("invalid -progress-theme value %q: must be unicode or ascii", *progressTheme)
+	}
+	if *localArtworkPaths && !*downloadArtwork && !*artworkByArtist && *downloadDir == "" {
+		fatal("-local-artwork-paths needs the artworks to be downloaded, with -download-artwork or -download-dir")
+	}
+	if *limit < 0 {
+		fatalf("invalid -limit value %d: must be positive, or 0 for all streams", *limit)
+	}
+	if _, err := filepath.Match(*pattern, ""); err != nil {
+		fatalf("invalid -pattern value %q: %v", *pattern, err)
+	}
+	if _, ok := endsong.ImageWidths[*imageSize]; !ok {
+		fatalf("invalid -image-size value %q: must be small, medium or large", *imageSize)
+	}
+	var sinceTime, untilTime time.Time
+	if *since != "" {
+		if sinceTime, _, err = parseDate(*since); err != nil {
+			fatalf("invalid -since value %q: %v", *since, err)
+		}
+	}
+	if *until != "" {
+		var untilStart time.Time
+		if untilStart, untilTime, err = parseDate(*until); err != nil {
+			fatalf("invalid -until value %q: %v", *until, err)
+		}
+		if !sinceTime.IsZero() && untilStart.Before(sinceTime) {
+			fatalf("invalid -until value %q: before -since %q", *until, *since)
+		}
+	}
+	switch *splitBy {
+	case "", "year", "platform":
+	default:
+		fatalf("invalid -split-by value %q: must be year or platform", *splitBy)
+	}
+	if *splitByPlatform {
+		if *splitBy != "" && *splitBy != "platform" {
+			fatalf("-split-by-platform can't be used with -split-by=%s", *splitBy)
+		}
+		*splitBy = "platform"
+	}
+	switch *sortOrder {
+	case "ts-asc", "none":
+	case "ts-desc", "duration":
+		if *noSort {
+			fatalf("-no-sort can't be used with -sort=%s", *sortOrder)
+		}
+	default:
+		fatalf("invalid -sort value %q: must be ts-asc, ts-desc, none or duration", *sortOrder)
+	}
+	if *sortOrder == "none" {
+		*noSort = true
+	}
+
+	if *validateCredentialsOnly {
+		validateCredentials()
+		return
+	}
+
+	// Check credentials before spending time reading files. With a metadata
+	// file, they're only needed for the tracks missing from it.
+	if *metadataFile == "" && !*dryRun && *outputFormat != "prometheus" {
+		checkCredentials()
+	}
+
+	// Read unsorted streams files, unless they're cached. Files given as
+	// arguments are read instead of the input directory's, and zip archives
+	// are read without extracting them.
+	fileNames := flag.Args()
+	if len(fileNames) == 0 {
+		checkInputDir(*inputDir)
+		if endsong.IsZip(*inputDir) {
+			fileNames = []string{*inputDir}
+		} else {
+			fileNames, err = endsong.FindFiles(*inputDir, *pattern)
+			if err != nil {
+				fatal("Error while reading directory", err)
+			}
+		}
+	}
+	// A dry run doesn't write the cache, so it isn't worth checksumming the
+	// files to read it either.
+	useStreamsCache := *streamsCacheFile != "" && !*noCache && !*dryRun
+	cache := streamsCache{Sorted: !*noSort, Lenient: *lenient, Pattern: *pattern}
+	cached := false
+	if useStreamsCache {
+		cache.Checksums = checksumFiles(fileNames)
+		cache, cached = readStreamsCache(*streamsCacheFile, cache)
+	}
+	printDebug("Input files: %s", strings.Join(fileNames, ", "))
+	if cached {
+		printDebug("Using the streams cached in %s.", *streamsCacheFile)
+	}
+	if !cached {
+		readOptions := endsong.ReadOptions{
+			Lenient: *lenient,
+			OnFile:  func(f endsong.FileStats) { printDone("%s done!", f.FileName) },
+			Pattern: *pattern,
+			Logger:  cliLogger{},
+		}
+		cache.Streams, cache.Files, err = endsong.ReadFiles(fileNames, readOptions)
+		if err != nil {
+			fatal("Error when reading file: ", err)
+		}
+
+		// Sort streams
+		if !*noSort {
+			sort.SliceStable(cache.Streams, func(i, j int) bool {
+				return cache.Streams[i].Ts.Before(cache.Streams[j].Ts)
+			})
+		}
+
+		if useStreamsCache {
+			writeStreamsCache(*streamsCacheFile, cache)
+		}
+	}
+	allStreams := cache.Streams
+
+	// Read the previous output to merge into
+	var mergedStreams []endsong.Stream
+	if *mergeFile != "" {
+		mergedStreams, _, err = endsong.ReadFiles([]string{*mergeFile}, endsong.ReadOptions{Logger: cliLogger{}})
+		if err != nil {
+			fatal("Error when reading file: ", err)
+		}
+	}
+
+	// Keep the IDs of the whole input, before it's filtered, to prune the
+	// artwork caches
+	var referencedTrackIDs, referencedEpisodeIDs map[string]bool
+	if *pruneCache {
+		referencedTrackIDs, referencedEpisodeIDs = referencedIDs(mergedStreams, allStreams)
+	}
+
+	// Only keep the streams of one account
+	if usernames := distinctUsernames(allStreams); len(usernames) > 0 {
+		printInfo("Usernames: %s", strings.Join(usernames, ", "))
+	}
+	if *username != "" {
+		var filtered int
+		allStreams, filtered = filterUsername(allStreams, *username)
+		printInfo("%d streams of other usernames removed.", filtered)
+	}
+
+	// Only keep the streams of the date range
+	if !sinceTime.IsZero() || !untilTime.IsZero() {
+		var filtered int
+		allStreams, filtered = filterDateRange(allStreams, sinceTime, untilTime)
+		printInfo("%d streams outside of the date range removed.", filtered)
+	}
+
+	// Remove duplicate streams
+	if *dedupe {
+		var duplicates int
+		allStreams, duplicates = dedupeStreams(allStreams)
+		printInfo("%d duplicate streams removed.", duplicates)
+	}
+
+	// Remove short streams
+	if *minMS > 0 {
+		var filtered int
+		allStreams, filtered = filterMinMS(allStreams, *minMS)
+		printInfo("%d streams shorter than %d ms removed.", filtered, *minMS)
+	}
+
+	// Only keep the first streams
+	if *limit > 0 && len(allStreams) > *limit {
+		printInfo("Keeping the first %d of %d streams.", *limit, len(allStreams))
+		allStreams = allStreams[:*limit]
+	}
+
+	// Merge into the previous output, whose streams keep their artwork. The
+	// filters above only apply to the new streams, so that writing the merge
+	// back never drops its history.
+	if *mergeFile != "" {
+		var added int
+		allStreams, added = mergeStreams(mergedStreams, allStreams)
+		printInfo("%d new streams merged into the %d streams of %s.", added, len(mergedStreams), *mergeFile)
+	}
+
+	// Print what each file contributed
+	if *fileStats {
+		for _, f := range cache.Files {
+			fmt.Fprintf(reportOutput(), "%s: %d streams, %s\n", f.FileName, f.Streams, (time.Duration(f.MSPlayed) * time.Millisecond).Round(time.Minute))
+		}
+	}
+
 	allStreamsCount := len(allStreams)
-	fmt.Printf("%d streams total.\n", allStreamsCount)
+	printInfo("%d streams total.", allStreamsCount)
 	if allStreamsCount == 0 {
 		return
 	}
 
-	// Sort streams
-	sort.SliceStable(allStreams, func(i, j int) bool {
-		return allStreams[i].Ts.Before(allStreams[j].Ts)
-	})
+	// Add session gaps
+	if !*noSort {
+		addGapsFromPrevious(allStreams)
+
+		sessions := computeSessions(allStreams, *sessionGap)
+		printInfo("%d sessions, %s long and %.1f streams each on average.", sessions.Sessions, sessions.AverageDuration.Round(time.Second), sessions.TracksPerSession)
+	}
+
+	// Only report what would be fetched
+	if *dryRun {
+		printDryRun(allStreams)
+		return
+	}
+
+	// Add stream IDs
+	if *addIDs {
+		for i := range allStreams {
+			allStreams[i].StreamID = streamID(allStreams[i])
+		}
+	}
+
+	// Write listening heatmap
+	if *exportHeatmap {
+		writeJSONFile("heatmap.json", computeHeatmap(allStreams))
+	}
+
+	// Write artist trends
+	if *exportArtistTrends {
+		writeJSONFile("artist_trends.json", computeArtistTrends(allStreams, *artistTrendsTop))
+	}
+
+	// Write listening stats
+	if *exportStats {
+		writeJSONFile("stats.json", computeListeningStats(allStreams, 10))
+	}
+
+	// Write listening metrics, which don't need artworks
+	if *outputFormat == "prometheus" {
+		writePrometheusFile("metrics.prom", allStreams, *prometheusTop)
+		return
+	}
 
 	// Add artwork URL to streams
-	allStreams = addStreamArtworks(allStreams)
+	artworkCache := make(map[string]endsong.Artwork)
+	episodeArtworkCache := make(map[string]endsong.Artwork)
+	artistArtworkCache := make(map[string]endsong.Artwork)
+	if !*noCache {
+		artworkCache = readArtworkCache(artworkCacheFile)
+		episodeArtworkCache = readArtworkCache(episodeArtworkCacheFile)
+		artistArtworkCache = readArtworkCache(artistArtworkCacheFile)
+	}
+	knownArtworks := make(map[string]endsong.Artwork)
+	for trackID, artwork := range artworkCache {
+		if artwork.Size() == *imageSize {
+			knownArtworks[trackID] = artwork
+		}
+	}
+	knownEpisodeArtworks := make(map[string]endsong.Artwork)
+	for episodeID, artwork := range episodeArtworkCache {
+		if artwork.Size() == *imageSize {
+			knownEpisodeArtworks[episodeID] = artwork
+		}
+	}
+	knownArtistArtworks := make(map[string]endsong.Artwork)
+	for artistID, artwork := range artistArtworkCache {
+		if artwork.Size() == *imageSize {
+			knownArtistArtworks[artistID] = artwork
+		}
+	}
+	if *metadataFile != "" {
+		for trackID, artwork := range readMetadataFile(*metadataFile) {
+			knownArtworks[trackID] = artwork
+		}
+	}
+	if *mergeFile != "" {
+		mergedArtworks, mergedEpisodeArtworks := streamArtworks(mergedStreams)
+		for trackID, artwork := range mergedArtworks {
+			if _, ok := knownArtworks[trackID]; !ok {
+				knownArtworks[trackID] = artwork
+			}
+		}
+		for episodeID, artwork := range mergedEpisodeArtworks {
+			if _, ok := knownEpisodeArtworks[episodeID]; !ok {
+				knownEpisodeArtworks[episodeID] = artwork
+			}
+		}
+	}
+	// Resume from the checkpoint of an interrupted run
+	var cp *checkpointer
+	if !*noCache {
+		var resumed checkpoint
+		cp, resumed = newCheckpointer(checkpointFile)
+		for trackID, artwork := range resumed.Tracks {
+			if artwork.Size() == *imageSize {
+				knownArtworks[trackID] = artwork
+			}
+		}
+		for episodeID, artwork := range resumed.Episodes {
+			if artwork.Size() == *imageSize {
+				knownEpisodeArtworks[episodeID] = artwork
+			}
+		}
+	}
+	printDebug("%d track and %d episode artworks known beforehand.", len(knownArtworks), len(knownEpisodeArtworks))
+	// Ctrl-C or SIGTERM cancels the lookups in flight, so that what was
+	// fetched can be saved before exiting. Another signal exits right away.
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+	artworks := endsong.AddArtworks(ctx, allStreams, endsong.ArtworkOptions{
+		Client:         func() endsong.TrackFetcher { return newSpotifyClient(ctx) },
+		Known:          knownArtworks,
+		KnownEpisodes:  knownEpisodeArtworks,
+		KnownArtists:   knownArtistArtworks,
+		Workers:        *workers,
+		Percentile:     *artworkPercentile,
+		ImageSize:      *imageSize,
+		OfflineTimeout: *offlineTimeout,
+		RequestTimeout: *requestTimeout,
+		EnrichMetadata: *enrichMetadata,
+		FailFast:       *failFast,
+		Market:         *market,
+		OnTrack:        cp.addTrack,
+		OnEpisode:      cp.addEpisode,
+		NewProgressBar: newProgressBar,
+		Logger:         cliLogger{},
+	})
+	printInfo("%d artworks total.", len(artworks.ArtworkByID))
+	if len(artworks.EpisodeArtworkByID) > 0 {
+		printInfo("%d episode artworks total.", len(artworks.EpisodeArtworkByID))
+	}
+	printInfo("Made %d API requests; %d cache hits.", artworks.Requests+int(rateLimitRetries.Load()), artworks.CacheHits)
+	if artworks.AlreadySet > 0 {
+		printInfo("%d streams already had artwork, kept as is.", artworks.AlreadySet)
+	}
+	if artworks.LocalTracks > 0 {
+		printInfo("%d local tracks (no artwork).", artworks.LocalTracks)
+	}
+	if len(artworks.Failed) > 0 {
+		printWarning("%d tracks could not be resolved.", len(artworks.Failed))
+	}
+	if len(artworks.FailedEpisodes) > 0 {
+		printWarning("%d episodes could not be resolved.", len(artworks.FailedEpisodes))
+	}
+
+	// Save artwork cache
+	if !*noCache {
+		for trackID, artwork := range artworks.ArtworkByID {
+			artworkCache[trackID] = artwork
+		}
+		for episodeID, artwork := range artworks.EpisodeArtworkByID {
+			episodeArtworkCache[episodeID] = artwork
+		}
+		if *pruneCache {
+			pruned := pruneArtworkCache(artworkCache, referencedTrackIDs)
+			prunedEpisodes := pruneArtworkCache(episodeArtworkCache, referencedEpisodeIDs)
+			printInfo("Pruned %d track and %d episode artworks no stream references from the caches.", pruned, prunedEpisodes)
+		}
+		writeArtworkCache(artworkCacheFile, artworkCache)
+		writeArtworkCache(episodeArtworkCacheFile, episodeArtworkCache)
+
+		for artistID, artwork := range artworks.ArtistArtworkByID {
+			artistArtworkCache[artistID] = artwork
+		}
+		writeArtworkCache(artistArtworkCacheFile, artistArtworkCache)
+	}
+	if ctx.Err() != nil {
+		cp.exitInterrupted()
+	}
+	if artworks.Err != nil {
+		cp.flush()
+		fatal("Error when fetching artwork: ", artworks.Err)
+	}
+	stop()
+	cp.remove()
+
+	// Write artwork mapping
+	if *exportArtworkCSV {
+		writeArtworkCSV("artwork.csv", artworks.ArtworkByID)
+	}
+
+	// Write summary
+	if *exportSummary {
+		decades := computeDecades(allStreams, artworks.ArtworkByID)
+		for _, d := range decades {
+			fmt.Fprintf(reportOutput(), "%s: %d plays, %s\n", d.Decade, d.Plays, (time.Duration(d.MSPlayed) * time.Millisecond).Round(time.Minute))
+		}
+		writeJSONFile("summary.json", struct {
+			ByDecade []DecadeStats `json:"by_decade"`
+		}{decades})
+	}
+
+	// Write streams with new artwork
+	if *changedOnly {
+		changedStreams := make([]endsong.Stream, 0, len(artworks.Changed))
+		for _, i := range artworks.Changed {
+			changedStreams = append(changedStreams, allStreams[i])
+		}
+		writeJSONFile("changed.json", changedStreams)
+	}
+
+	// Write streams without artwork
+	if *reportSkipped != "" {
+		skipped := skippedStreams(allStreams, artworks)
+		writeJSONFile(*reportSkipped, skipped)
+		printInfo("%d streams without artwork.", len(skipped))
+	}
+
+	// Download artwork images
+	var downloadedPaths map[string]string
+	if *downloadArtwork || *artworkByArtist || *downloadDir != "" {
+		dir := *downloadDir
+		if dir == "" {
+			dir = defaultArtworkDir
+		}
+		downloadedPaths = downloadArtworks(allStreams, artworks.ArtworkByID, dir, *artworkByArtist, *downloadConcurrency)
+	}
+
+	// Write album covers contact sheet
+	if *exportContactSheet {
+		writeContactSheet("contact_sheet.png", allStreams, *contactSheetGrid, *contactSheetCell)
+	}
+
+	// Point artworks to the downloaded images
+	if *localArtworkPaths {
+		for i := range allStreams {
+			trackID, _ := endsong.TrackIDFromURI(allStreams[i].SpotifyTrackURI)
+			if path, ok := downloadedPaths[trackID]; ok {
+				path := filepath.ToSlash(path)
+				allStreams[i].ArtworkURL = &path
+			}
+		}
+	}
+
+	// Order streams for output, now that gaps and sessions are computed
+	sortStreams(allStreams, *sortOrder)
+
+	// Write missing artworks as empty strings rather than null
+	if *emitEmptyArtworkField {
+		for i := range allStreams {
+			if allStreams[i].ArtworkURL == nil {
+				allStreams[i].ArtworkURL = new(string)
+			}
+		}
+	}
 
 	// Write sorted streams file
-	writeSortedFile(allStreams)
+	if *splitBy != "" {
+		writeSplitFiles(allStreams, fields, *splitBy)
+	} else {
+		fileName := *output
+		if fileName == "" && *mergeFile != "" && *outputFormat == "json" {
+			fileName = *mergeFile
+		} else if fileName == "" {
+			fileName = "sorted_streams." + *outputFormat
+		}
+		writeStreamsFile(fileName, allStreams, fields)
+		printDone("%d streams sorted!", len(allStreams))
+	}
+}
+
+// isCountryCode reports whether code looks like an ISO 3166-1 alpha-2 country
+// code, in either case.
+func isCountryCode(code string) bool {
+	if len(code) != 2 {
+		return false
+	}
+	for _, r := range code {
+		if (r < 'A' || r > 'Z') && (r < 'a' || r > 'z') {
+			return false
+		}
+	}
+	return true
 }
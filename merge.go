@@ -0,0 +1,72 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+// mergeKey identifies a stream across runs by its timestamp and URI.
+func mergeKey(s endsong.Stream) string {
+	uri := s.SpotifyTrackURI
+	if uri == "" && s.SpotifyEpisodeURI != nil {
+		uri = *s.SpotifyEpisodeURI
+	}
+	return fmt.Sprintf("%s|%s", s.Ts.UTC().Format(time.RFC3339Nano), uri)
+}
+
+// mergeStreams returns the streams of a previous output followed by the new
+// streams it doesn't have yet, sorted by timestamp unless -no-sort is set, and
+// how many new streams were added.
+func mergeStreams(existing, newStreams []endsong.Stream) ([]endsong.Stream, int) {
+	merged := make([]endsong.Stream, 0, len(existing)+len(newStreams))
+	seen := make(map[string]bool)
+	for _, s := range existing {
+		seen[mergeKey(s)] = true
+		merged = append(merged, s)
+	}
+
+	added := 0
+	for _, s := range newStreams {
+		key := mergeKey(s)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		merged = append(merged, s)
+		added++
+	}
+
+	if !*noSort {
+		sort.SliceStable(merged, func(i, j int) bool {
+			return merged[i].Ts.Before(merged[j].Ts)
+		})
+	}
+
+	return merged, added
+}
+
+// streamArtworks returns the artworks already in the streams, e.g. those of a
+// previous output, keyed by track and episode ID.
+func streamArtworks(allStreams []endsong.Stream) (map[string]endsong.Artwork, map[string]endsong.Artwork) {
+	artworkByID := make(map[string]endsong.Artwork)
+	episodeArtworkByID := make(map[string]endsong.Artwork)
+	for _, s := range allStreams {
+		if s.ArtworkURL == nil || *s.ArtworkURL == "" {
+			continue
+		}
+		artwork := endsong.Artwork{URL: *s.ArtworkURL, ImageSize: *imageSize}
+		if s.ArtworkSource == endsong.ArtworkSourceArtist {
+			artwork.Source = s.ArtworkSource
+		}
+
+		if episodeID, ok := endsong.EpisodeIDFromURI(s.SpotifyEpisodeURI); ok {
+			episodeArtworkByID[episodeID] = artwork
+		} else if trackID, ok := endsong.TrackIDFromURI(s.SpotifyTrackURI); ok {
+			artworkByID[trackID] = artwork
+		}
+	}
+	return artworkByID, episodeArtworkByID
+}
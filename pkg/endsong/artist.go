@@ -0,0 +1,65 @@
+package endsong
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// artistFallback is a track whose album has no images, to be given the image
+// of its primary artist instead.
+type artistFallback struct {
+	trackName string
+	artistID  spotify.ID
+	// artwork is the track's artwork without a URL.
+	artwork Artwork
+}
+
+// artistArtwork looks up an artist and returns their image as an artwork.
+// Failures are logged and reported as not ok.
+func (f fetcher) artistArtwork(ctx context.Context, artistID spotify.ID) (Artwork, bool) {
+	var artist *spotify.FullArtist
+	err := f.retryOffline(ctx, func(ctx context.Context) error {
+		var err error
+		artist, err = f.client.GetArtist(ctx, artistID)
+		return err
+	})
+	if err != nil && ctx.Err() != nil {
+		return Artwork{}, false
+	}
+	if err != nil && f.failFast != nil {
+		f.failFast(fmt.Errorf("getting Spotify artist %s: %w", artistID, err))
+		return Artwork{}, false
+	}
+	if isTimeout(ctx, err) {
+		f.logger.Warnf("Timed out after %s when getting Spotify artist %s.", f.requestTimeout, artistID)
+		return Artwork{}, false
+	}
+	if err != nil {
+		f.logger.Warnf("Error when getting Spotify artist %s: %v", artistID, err)
+		return Artwork{}, false
+	}
+	if len(artist.Images) == 0 {
+		return Artwork{}, false
+	}
+
+	image := selectImage(artist.Images, f.imageSize, artistID, f.logger)
+	return Artwork{URL: image.URL, ImageSize: f.imageSize, Source: ArtworkSourceArtist}, true
+}
+
+// artistResult is the outcome of looking up one artist.
+type artistResult struct {
+	artistID spotify.ID
+	artwork  Artwork
+	ok       bool
+}
+
+// artistArtworksConcurrently looks up the artists with workers concurrent
+// lookups, see runPool.
+func (f fetcher) artistArtworksConcurrently(ctx context.Context, artistIDs []spotify.ID, workers int) <-chan artistResult {
+	return runPool(ctx, artistIDs, workers, func(artistID spotify.ID) artistResult {
+		artwork, ok := f.artistArtwork(ctx, artistID)
+		return artistResult{artistID: artistID, artwork: artwork, ok: ok}
+	})
+}
@@ -0,0 +1,610 @@
+package endsong
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+	"github.com/zmb3/spotify/v2"
+)
+
+// IsLocalURI reports whether uri is the URI of a streamed local file, e.g.
+// "spotify:local:Artist:Album:Title:240", which isn't in Spotify's catalog.
+func IsLocalURI(uri string) bool {
+	_, kind, ok := parseTrackID(uri)
+	return ok && kind == "local"
+}
+
+// TrackIDFromURI returns the ID of a "spotify:track:<id>" URI.
+func TrackIDFromURI(uri string) (string, bool) {
+	id, kind, ok := parseTrackID(uri)
+	if !ok || kind != "track" {
+		return "", false
+	}
+	return id, true
+}
+
+// HasArtwork reports whether s already has an artwork URL, e.g. from a
+// previous run or set by hand. An empty URL, which some outputs write for
+// missing artworks, doesn't count.
+func (s Stream) HasArtwork() bool {
+	return s.ArtworkURL != nil && *s.ArtworkURL != ""
+}
+
+// parseTrackID returns the ID and the resource kind ("track", "episode" or
+// "local") of a "spotify:<kind>:<id>" URI. The ID of a local file is the rest
+// of its URI. Other URIs, or URIs without an ID or with a malformed one, are
+// not ok.
+func parseTrackID(uri string) (id, kind string, ok bool) {
+	parts := strings.SplitN(uri, ":", 3)
+	if len(parts) < 3 || parts[0] != "spotify" || parts[2] == "" {
+		return "", "", false
+	}
+	switch parts[1] {
+	case "track", "episode":
+		if strings.Contains(parts[2], ":") {
+			return "", "", false
+		}
+		return parts[2], parts[1], true
+	case "local":
+		return parts[2], parts[1], true
+	}
+	return "", "", false
+}
+
+// MaxTracksPerRequest is the maximum number of IDs accepted by GET /v1/tracks.
+const MaxTracksPerRequest = 50
+
+// TrackFetcher is the part of the Spotify API artworks are fetched from. It's
+// implemented by *spotify.Client, and can be faked to run AddArtworks without
+// the API.
+type TrackFetcher interface {
+	GetTracks(ctx context.Context, ids []spotify.ID, opts ...spotify.RequestOption) ([]*spotify.FullTrack, error)
+	GetEpisode(ctx context.Context, id string, opts ...spotify.RequestOption) (*spotify.EpisodePage, error)
+	GetArtist(ctx context.Context, id spotify.ID) (*spotify.FullArtist, error)
+}
+
+var _ TrackFetcher = (*spotify.Client)(nil)
+
+// ArtworkOptions configures AddArtworks.
+type ArtworkOptions struct {
+	// Client returns the client artworks are fetched with. It's only called
+	// when some artworks are missing from Known and KnownEpisodes, and is
+	// required then: without it, only the known artworks are added and
+	// ArtworkResult.Err is set.
+	Client func() TrackFetcher
+	// Known and KnownEpisodes are artworks resolved beforehand, e.g. by a
+	// previous run, keyed by track and episode ID. They're used as is.
+	Known         map[string]Artwork
+	KnownEpisodes map[string]Artwork
+	// KnownArtists are the artist images resolved beforehand, keyed by artist
+	// ID, for the tracks whose album has no images.
+	KnownArtists map[string]Artwork
+	// Workers is the number of concurrent lookups.
+	Workers int
+	// Percentile, if positive, only fetches artwork for the tracks whose total
+	// playtime is at or above this percentile (between 0 and 1) of all tracks.
+	Percentile float64
+	// ImageSize is the image size keyword of the artworks, see ImageWidths.
+	// Defaults to large.
+	ImageSize string
+	// OfflineTimeout is how long lookups keep being retried while the network
+	// is unreachable.
+	OfflineTimeout time.Duration
+	// EnrichMetadata also sets the track metadata fields of the streams. Known
+	// artworks without metadata are then fetched again.
+	EnrichMetadata bool
+	// FailFast stops at the first failed API request, or the first track the
+	// API can't resolve, instead of logging it and carrying on without the
+	// artworks it would have resolved. The error is returned in
+	// ArtworkResult.Err.
+	FailFast bool
+	// RequestTimeout, if positive, bounds each API request. Timed out
+	// lookups are retried like network errors.
+	RequestTimeout time.Duration
+	// Market, if set, is the ISO 3166-1 alpha-2 country code tracks and
+	// episodes are looked up in. Some tracks are relinked per market and only
+	// resolve with one. Episodes default to the US market.
+	Market string
+	// OnTrack and OnEpisode, if set, are called with each fetched artwork.
+	// They may be called concurrently.
+	OnTrack   func(trackID string, artwork Artwork)
+	OnEpisode func(episodeID string, artwork Artwork)
+	// NewProgressBar, if set, returns the bar showing the progress of the
+	// lookups.
+	NewProgressBar func(max int64) *progressbar.ProgressBar
+	Logger         Logger
+}
+
+// ArtworkResult is what AddArtworks resolved, besides the streams.
+type ArtworkResult struct {
+	ArtworkByID        map[string]Artwork
+	EpisodeArtworkByID map[string]Artwork
+	// ArtistArtworkByID holds the artist images resolved for the tracks whose
+	// album has none, keyed by artist ID.
+	ArtistArtworkByID map[string]Artwork
+	// AlreadySet is the number of streams that already had an artwork URL,
+	// which was kept.
+	AlreadySet int
+	// Changed holds the indices of the streams that got artwork fetched
+	// during this run.
+	Changed []int
+	// Failed and FailedEpisodes are the tracks and episodes that could not be
+	// resolved.
+	Failed         []spotify.ID
+	FailedEpisodes []string
+	// NoImage are the tracks that were resolved but got no image: their album
+	// has none, and their primary artist none or couldn't be looked up.
+	NoImage []spotify.ID
+	// LocalTracks is the number of distinct local files streamed, which have
+	// no artwork on Spotify.
+	LocalTracks int
+	// Requests is the number of track, episode and artist requests sent to
+	// the API, not counting those the client resends itself, e.g. on rate
+	// limiting, and CacheHits the number of tracks, episodes and artists that
+	// were known beforehand instead.
+	Requests  int
+	CacheHits int
+	// Err is the failure that stopped the lookups early with FailFast, or the
+	// missing Client.
+	Err error
+}
+
+// AddArtworks adds artwork URLs to the streams of tracks and podcast episodes.
+// Tracks found in opts.Known and episodes found in opts.KnownEpisodes are used
+// as is, and only the others are fetched from Spotify. Tracks whose album has
+// no images get the image of their primary artist instead. Streams that
+// already have an artwork URL keep it, and are only looked up for the metadata
+// they lack with opts.EnrichMetadata.
+//
+// Cancelling ctx stops the lookups early: in-flight requests are aborted, and
+// the result and streams only hold what was resolved until then. A failure
+// with opts.FailFast stops them the same way.
+func AddArtworks(ctx context.Context, allStreams []Stream, opts ArtworkOptions) ArtworkResult {
+	logger := orDefault(opts.Logger)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	newProgressBar := opts.NewProgressBar
+	if newProgressBar == nil {
+		newProgressBar = func(max int64) *progressbar.ProgressBar { return progressbar.DefaultSilent(max) }
+	}
+	f := fetcher{
+		imageSize:      Artwork{ImageSize: opts.ImageSize}.Size(),
+		offlineTimeout: opts.OfflineTimeout,
+		requestTimeout: opts.RequestTimeout,
+		market:         opts.Market,
+		requests:       new(atomic.Int64),
+		logger:         logger,
+	}
+	var firstErr error
+	if opts.FailFast {
+		var once sync.Once
+		f.failFast = func(err error) {
+			once.Do(func() {
+				firstErr = err
+				cancel()
+			})
+		}
+	}
+	cacheHits := 0
+
+	// Collect unique track and episode IDs
+	var trackIDs []spotify.ID
+	var episodeIDs []string
+	streamTrackIDs := make([]string, len(allStreams))
+	streamEpisodeIDs := make([]string, len(allStreams))
+	seenIDs := make(map[string]bool)
+	seenEpisodeIDs := make(map[string]bool)
+	msPlayedByID := make(map[string]int64)
+	localURIs := make(map[string]bool)
+	keepArtwork := make([]bool, len(allStreams))
+	alreadySet := 0
+	for i := 0; i < len(allStreams); i++ {
+		episodeID, isEpisode := EpisodeIDFromURI(allStreams[i].SpotifyEpisodeURI)
+		if allStreams[i].HasArtwork() {
+			keepArtwork[i] = true
+			alreadySet++
+			if !opts.EnrichMetadata || isEpisode || allStreams[i].TrackDurationMS != nil {
+				continue
+			}
+		}
+
+		if isEpisode {
+			streamEpisodeIDs[i] = episodeID
+			if !seenEpisodeIDs[episodeID] {
+				episodeIDs = append(episodeIDs, episodeID)
+			}
+			seenEpisodeIDs[episodeID] = true
+			continue
+		}
+
+		trackID, kind, ok := parseTrackID(allStreams[i].SpotifyTrackURI)
+		if kind == "local" {
+			// Local files aren't in the catalog, so there's nothing to look up
+			localURIs[allStreams[i].SpotifyTrackURI] = true
+			continue
+		}
+		if !ok || kind != "track" {
+			continue
+		}
+
+		streamTrackIDs[i] = trackID
+		if !seenIDs[trackID] {
+			trackIDs = append(trackIDs, spotify.ID(trackID))
+		}
+		seenIDs[trackID] = true
+		msPlayedByID[trackID] += allStreams[i].MSPlayed
+	}
+
+	if opts.Percentile > 0 {
+		trackIDs = filterPlaytimePercentile(trackIDs, msPlayedByID, opts.Percentile, logger)
+	}
+
+	// Use known artworks, and only fetch the missing ones. Known artworks
+	// without metadata are kept should fetching them again fail.
+	artworkByID := make(map[string]Artwork)
+	var missingIDs []spotify.ID
+	for _, trackID := range trackIDs {
+		artwork, ok := opts.Known[string(trackID)]
+		if ok {
+			artworkByID[string(trackID)] = artwork
+		}
+		if !ok || (opts.EnrichMetadata && artwork.Metadata == nil) {
+			missingIDs = append(missingIDs, trackID)
+		} else {
+			cacheHits++
+		}
+	}
+	episodeArtworkByID := make(map[string]Artwork)
+	var missingEpisodeIDs []string
+	for _, episodeID := range episodeIDs {
+		if artwork, ok := opts.KnownEpisodes[episodeID]; ok {
+			episodeArtworkByID[episodeID] = artwork
+			cacheHits++
+		} else {
+			missingEpisodeIDs = append(missingEpisodeIDs, episodeID)
+		}
+	}
+
+	if len(missingIDs) > 0 || len(missingEpisodeIDs) > 0 {
+		if opts.Client != nil {
+			f.client = opts.Client()
+		}
+		if f.client == nil {
+			firstErr = errors.New("no Spotify client to fetch the missing artworks with")
+			missingIDs, missingEpisodeIDs = nil, nil
+		}
+	}
+
+	// Fetch track artworks in batches. Progress is counted in unique IDs to
+	// look up, which is what takes time, rather than in streams.
+	fetchedIDs := make(map[string]bool)
+	var failedIDs []spotify.ID
+	fallbacks := make(map[string]artistFallback)
+	if len(missingIDs) > 0 {
+		bar := newProgressBar(int64(len(missingIDs)))
+		for result := range f.trackArtworksConcurrently(ctx, batchIDs(missingIDs, MaxTracksPerRequest), opts.Workers) {
+			for trackID, artwork := range result.artworks {
+				artworkByID[trackID] = artwork
+				fetchedIDs[trackID] = true
+				if opts.OnTrack != nil {
+					opts.OnTrack(trackID, artwork)
+				}
+			}
+			failedIDs = append(failedIDs, result.failed...)
+			for trackID, fallback := range result.fallbacks {
+				fallbacks[trackID] = fallback
+			}
+			bar.Add(len(result.batch))
+		}
+		if ctx.Err() != nil {
+			bar.Exit()
+		}
+	}
+
+	// Fall back to the artist image for the tracks whose album has none
+	artistArtworkByID := make(map[string]Artwork)
+	var missingArtistIDs []spotify.ID
+	seenArtistIDs := make(map[string]bool)
+	for _, fallback := range fallbacks {
+		artistID := string(fallback.artistID)
+		if seenArtistIDs[artistID] {
+			continue
+		}
+		seenArtistIDs[artistID] = true
+		if artwork, ok := opts.KnownArtists[artistID]; ok {
+			artistArtworkByID[artistID] = artwork
+			cacheHits++
+		} else {
+			missingArtistIDs = append(missingArtistIDs, fallback.artistID)
+		}
+	}
+	if len(missingArtistIDs) > 0 && ctx.Err() == nil {
+		bar := newProgressBar(int64(len(missingArtistIDs)))
+		for result := range f.artistArtworksConcurrently(ctx, missingArtistIDs, opts.Workers) {
+			if result.ok {
+				artistArtworkByID[string(result.artistID)] = result.artwork
+			}
+			bar.Add(1)
+		}
+		if ctx.Err() != nil {
+			bar.Exit()
+		}
+	}
+	var noImageIDs []spotify.ID
+	for trackID, fallback := range fallbacks {
+		artistArtwork, ok := artistArtworkByID[string(fallback.artistID)]
+		if !ok {
+			if ctx.Err() == nil {
+				logger.Warnf("No artwork for %q (%s).", fallback.trackName, trackID)
+				noImageIDs = append(noImageIDs, spotify.ID(trackID))
+			}
+			continue
+		}
+		artwork := fallback.artwork
+		artwork.URL = artistArtwork.URL
+		artwork.Source = ArtworkSourceArtist
+		artworkByID[trackID] = artwork
+		fetchedIDs[trackID] = true
+		if opts.OnTrack != nil {
+			opts.OnTrack(trackID, artwork)
+		}
+	}
+
+	// Fetch episode artworks
+	fetchedEpisodeIDs := make(map[string]bool)
+	var failedEpisodeIDs []string
+	if len(missingEpisodeIDs) > 0 && ctx.Err() == nil {
+		bar := newProgressBar(int64(len(missingEpisodeIDs)))
+		for result := range f.episodeArtworksConcurrently(ctx, missingEpisodeIDs, opts.Workers) {
+			if result.ok {
+				episodeArtworkByID[result.episodeID] = result.artwork
+				fetchedEpisodeIDs[result.episodeID] = true
+				if opts.OnEpisode != nil {
+					opts.OnEpisode(result.episodeID, result.artwork)
+				}
+			} else if ctx.Err() == nil {
+				failedEpisodeIDs = append(failedEpisodeIDs, result.episodeID)
+			}
+			bar.Add(1)
+		}
+		if ctx.Err() != nil {
+			bar.Exit()
+		}
+	}
+
+	// Add artwork URLs to streams
+	var changed []int
+	for i := 0; i < len(allStreams); i++ {
+		if keepArtwork[i] {
+			if trackArtwork, ok := artworkByID[streamTrackIDs[i]]; ok && opts.EnrichMetadata {
+				addMetadata(&allStreams[i], trackArtwork)
+			}
+			continue
+		}
+		if trackArtwork, ok := artworkByID[streamTrackIDs[i]]; ok {
+			allStreams[i].ArtworkURL = &trackArtwork.URL
+			allStreams[i].ArtworkSource = ArtworkSourceAlbum
+			if trackArtwork.Source != "" {
+				allStreams[i].ArtworkSource = trackArtwork.Source
+			}
+			if opts.EnrichMetadata {
+				addMetadata(&allStreams[i], trackArtwork)
+			}
+			if fetchedIDs[streamTrackIDs[i]] {
+				changed = append(changed, i)
+			}
+		} else if episodeArtwork, ok := episodeArtworkByID[streamEpisodeIDs[i]]; ok {
+			allStreams[i].ArtworkURL = &episodeArtwork.URL
+			allStreams[i].ArtworkSource = ArtworkSourceEpisode
+			if fetchedEpisodeIDs[streamEpisodeIDs[i]] {
+				changed = append(changed, i)
+			}
+		}
+	}
+
+	return ArtworkResult{
+		ArtworkByID:        artworkByID,
+		EpisodeArtworkByID: episodeArtworkByID,
+		ArtistArtworkByID:  artistArtworkByID,
+		Changed:            changed,
+		Failed:             failedIDs,
+		FailedEpisodes:     failedEpisodeIDs,
+		NoImage:            noImageIDs,
+		LocalTracks:        len(localURIs),
+		AlreadySet:         alreadySet,
+		Requests:           int(f.requests.Load()),
+		CacheHits:          cacheHits,
+		Err:                firstErr,
+	}
+}
+
+// addMetadata sets the track metadata fields of s from its artwork.
+func addMetadata(s *Stream, artwork Artwork) {
+	if artwork.ReleaseDate != "" {
+		s.AlbumReleaseDate = &artwork.ReleaseDate
+	}
+	if m := artwork.Metadata; m != nil {
+		s.TrackDurationMS = &m.DurationMS
+		s.TrackPopularity = &m.Popularity
+		s.Explicit = &m.Explicit
+		s.TrackNumber = &m.TrackNumber
+		s.DiscNumber = &m.DiscNumber
+	}
+}
+
+// fetcher looks up artworks with the settings of an AddArtworks call.
+type fetcher struct {
+	client         TrackFetcher
+	imageSize      string
+	offlineTimeout time.Duration
+	requestTimeout time.Duration
+	market         string
+	// requests counts the API requests sent, across workers.
+	requests *atomic.Int64
+	// failFast, if set, is called with the first failed request to stop the
+	// lookups.
+	failFast func(err error)
+	logger   Logger
+}
+
+// batchResult is the outcome of looking up one batch of tracks.
+type batchResult struct {
+	batch     []spotify.ID
+	artworks  map[string]Artwork
+	failed    []spotify.ID
+	fallbacks map[string]artistFallback
+}
+
+// trackArtworksConcurrently looks up the batches with workers concurrent
+// lookups, see runPool.
+func (f fetcher) trackArtworksConcurrently(ctx context.Context, batches [][]spotify.ID, workers int) <-chan batchResult {
+	return runPool(ctx, batches, workers, func(batch []spotify.ID) batchResult {
+		artworks, failed, fallbacks := f.trackArtworks(ctx, batch)
+		return batchResult{batch: batch, artworks: artworks, failed: failed, fallbacks: fallbacks}
+	})
+}
+
+// batchIDs splits ids into batches of at most size IDs, for endpoints taking
+// several IDs per request.
+func batchIDs(ids []spotify.ID, size int) [][]spotify.ID {
+	var batches [][]spotify.ID
+	for start := 0; start < len(ids); start += size {
+		end := start + size
+		if end > len(ids) {
+			end = len(ids)
+		}
+		batches = append(batches, ids[start:end])
+	}
+	return batches
+}
+
+// filterPlaytimePercentile keeps the tracks whose total playtime is at or
+// above the given percentile (between 0 and 1) of all tracks' playtime.
+func filterPlaytimePercentile(trackIDs []spotify.ID, msPlayedByID map[string]int64, percentile float64, logger Logger) []spotify.ID {
+	if len(trackIDs) == 0 {
+		return trackIDs
+	}
+
+	playtimes := make([]int64, 0, len(trackIDs))
+	var totalMS int64
+	for _, trackID := range trackIDs {
+		playtimes = append(playtimes, msPlayedByID[string(trackID)])
+		totalMS += msPlayedByID[string(trackID)]
+	}
+	sort.Slice(playtimes, func(i, j int) bool { return playtimes[i] < playtimes[j] })
+	threshold := playtimes[int(percentile*float64(len(playtimes)-1))]
+
+	var kept []spotify.ID
+	var keptMS int64
+	for _, trackID := range trackIDs {
+		if msPlayedByID[string(trackID)] >= threshold {
+			kept = append(kept, trackID)
+			keptMS += msPlayedByID[string(trackID)]
+		}
+	}
+
+	share := 100.0
+	if totalMS > 0 {
+		share = float64(keptMS) / float64(totalMS) * 100
+	}
+	logger.Printf("Fetching artwork for %d of %d tracks (%.1f%% of playtime).", len(kept), len(trackIDs), share)
+
+	return kept
+}
+
+// trackArtworks looks up a batch of at most MaxTracksPerRequest tracks and
+// returns their artworks keyed by track ID. Spotify returns null for IDs it
+// can't resolve (e.g. dead tracks in old exports): those are skipped and
+// returned as failed instead, unless the lookup was cancelled. Tracks whose album has no images are returned as
+// fallbacks, keyed by track ID, with the artist to take the image from.
+//
+// A failed request is logged rather than aborting the run. As a single
+// malformed ID fails its whole batch, the tracks of a failed batch are then
+// looked up one by one, and only those still failing are returned as failed.
+func (f fetcher) trackArtworks(ctx context.Context, trackIDs []spotify.ID) (map[string]Artwork, []spotify.ID, map[string]artistFallback) {
+	artworkByID := make(map[string]Artwork)
+	var failedIDs []spotify.ID
+	fallbacks := make(map[string]artistFallback)
+
+	tracks, err := f.getTracks(ctx, trackIDs)
+	if err != nil && ctx.Err() != nil {
+		return artworkByID, nil, fallbacks
+	}
+	if err != nil && f.failFast != nil {
+		f.failFast(fmt.Errorf("getting Spotify tracks %v: %w", trackIDs, err))
+		return artworkByID, nil, fallbacks
+	}
+	if err != nil {
+		if len(trackIDs) == 1 || isNetworkError(err) || isRateLimited(err) {
+			f.logger.Warnf("Error when getting Spotify tracks %v: %v", trackIDs, err)
+			return artworkByID, trackIDs, fallbacks
+		}
+
+		for _, trackID := range trackIDs {
+			artworks, failed, trackFallbacks := f.trackArtworks(ctx, []spotify.ID{trackID})
+			for id, artwork := range artworks {
+				artworkByID[id] = artwork
+			}
+			failedIDs = append(failedIDs, failed...)
+			for id, fallback := range trackFallbacks {
+				fallbacks[id] = fallback
+			}
+		}
+		return artworkByID, failedIDs, fallbacks
+	}
+
+	for i, trackID := range trackIDs {
+		if i >= len(tracks) || tracks[i] == nil {
+			if f.failFast != nil {
+				f.failFast(fmt.Errorf("Spotify track %s not found", trackID))
+				return artworkByID, nil, fallbacks
+			}
+			failedIDs = append(failedIDs, trackID)
+			continue
+		}
+		if len(tracks[i].Album.Images) == 0 {
+			if len(tracks[i].Artists) == 0 {
+				f.logger.Warnf("No artwork for %q (%s).", tracks[i].Name, trackID)
+				continue
+			}
+			fallbacks[string(trackID)] = artistFallback{
+				trackName: tracks[i].Name,
+				artistID:  tracks[i].Artists[0].ID,
+				artwork: Artwork{
+					AlbumID:     string(tracks[i].Album.ID),
+					ReleaseDate: tracks[i].Album.ReleaseDate,
+					ImageSize:   f.imageSize,
+					Metadata:    trackMetadata(tracks[i]),
+				},
+			}
+			continue
+		}
+		artworkByID[string(trackID)] = Artwork{
+			AlbumID:     string(tracks[i].Album.ID),
+			URL:         selectImage(tracks[i].Album.Images, f.imageSize, trackID, f.logger).URL,
+			ReleaseDate: tracks[i].Album.ReleaseDate,
+			ImageSize:   f.imageSize,
+			Metadata:    trackMetadata(tracks[i]),
+		}
+	}
+
+	return artworkByID, failedIDs, fallbacks
+}
+
+// trackMetadata returns the metadata of a looked up track.
+func trackMetadata(track *spotify.FullTrack) *TrackMetadata {
+	return &TrackMetadata{
+		DurationMS:  int(track.Duration),
+		Popularity:  int(track.Popularity),
+		Explicit:    track.Explicit,
+		TrackNumber: int(track.TrackNumber),
+		DiscNumber:  int(track.DiscNumber),
+	}
+}
@@ -0,0 +1,473 @@
+package endsong
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// fakeClient is a TrackFetcher serving canned tracks. Tracks missing from it
+// come back as null entries, like the tracks Spotify can't resolve.
+type fakeClient struct {
+	tracks map[spotify.ID]*spotify.FullTrack
+
+	// failBatches fails the requests of more than one track, like a batch
+	// with an invalid ID.
+	failBatches bool
+
+	mu            sync.Mutex
+	trackRequests int
+	requestedIDs  []spotify.ID
+}
+
+func (c *fakeClient) GetTracks(ctx context.Context, ids []spotify.ID, opts ...spotify.RequestOption) ([]*spotify.FullTrack, error) {
+	c.mu.Lock()
+	c.trackRequests++
+	c.requestedIDs = append(c.requestedIDs, ids...)
+	failBatches := c.failBatches
+	c.mu.Unlock()
+	if failBatches && len(ids) > 1 {
+		return nil, spotify.Error{Message: "invalid id", Status: 400}
+	}
+
+	tracks := make([]*spotify.FullTrack, len(ids))
+	for i, id := range ids {
+		tracks[i] = c.tracks[id]
+	}
+	return tracks, nil
+}
+
+func (c *fakeClient) GetEpisode(ctx context.Context, id string, opts ...spotify.RequestOption) (*spotify.EpisodePage, error) {
+	return nil, spotify.Error{Message: "non existing id", Status: 404}
+}
+
+func (c *fakeClient) GetArtist(ctx context.Context, id spotify.ID) (*spotify.FullArtist, error) {
+	return nil, spotify.Error{Message: "non existing id", Status: 404}
+}
+
+// fakeTrack returns a track whose album has a single image at url.
+func fakeTrack(id spotify.ID, url string) *spotify.FullTrack {
+	track := &spotify.FullTrack{}
+	track.ID = id
+	track.Album.Images = []spotify.Image{{URL: url, Width: 640, Height: 640}}
+	return track
+}
+
+// testLogger logs to the test.
+type testLogger struct{ t *testing.T }
+
+func (l testLogger) Printf(format string, v ...interface{}) { l.t.Logf(format, v...) }
+func (l testLogger) Warnf(format string, v ...interface{})  { l.t.Logf(format, v...) }
+
+// trackStreams returns one stream per track ID.
+func trackStreams(trackIDs ...string) []Stream {
+	allStreams := make([]Stream, len(trackIDs))
+	for i, trackID := range trackIDs {
+		allStreams[i].SpotifyTrackURI = "spotify:track:" + trackID
+	}
+	return allStreams
+}
+
+func TestParseTrackID(t *testing.T) {
+	tests := []struct {
+		uri      string
+		wantID   string
+		wantKind string
+		wantOK   bool
+	}{
+		{uri: "spotify:track:4uLU6hMCjMI75M1A2tKUQC", wantID: "4uLU6hMCjMI75M1A2tKUQC", wantKind: "track", wantOK: true},
+		{uri: "spotify:episode:512ojhOuo1ktJprKbVcKyQ", wantID: "512ojhOuo1ktJprKbVcKyQ", wantKind: "episode", wantOK: true},
+		{uri: "spotify:local:Artist:Album:Title:240", wantID: "Artist:Album:Title:240", wantKind: "local", wantOK: true},
+		{uri: ""},
+		{uri: "spotify:track:"},
+		{uri: "spotify:track"},
+		{uri: "spotify:track::"},
+		{uri: "spotify:album:2noRn2Aes5aoNVsU6iWThc"},
+		{uri: "a:b"},
+		{uri: "a:track:4uLU6hMCjMI75M1A2tKUQC"},
+	}
+
+	for _, tt := range tests {
+		id, kind, ok := parseTrackID(tt.uri)
+		if id != tt.wantID || kind != tt.wantKind || ok != tt.wantOK {
+			t.Errorf("parseTrackID(%q) = %q, %q, %v, want %q, %q, %v", tt.uri, id, kind, ok, tt.wantID, tt.wantKind, tt.wantOK)
+		}
+	}
+}
+
+func TestTrackIDFromURI(t *testing.T) {
+	tests := []struct {
+		uri    string
+		wantID string
+		wantOK bool
+	}{
+		{uri: "spotify:track:4uLU6hMCjMI75M1A2tKUQC", wantID: "4uLU6hMCjMI75M1A2tKUQC", wantOK: true},
+		{uri: "spotify:episode:512ojhOuo1ktJprKbVcKyQ"},
+		{uri: "spotify:local:Artist:Album:Title:240"},
+		{uri: "spotify:track:"},
+		{uri: "spotify:track::"},
+	}
+
+	for _, tt := range tests {
+		id, ok := TrackIDFromURI(tt.uri)
+		if id != tt.wantID || ok != tt.wantOK {
+			t.Errorf("TrackIDFromURI(%q) = %q, %v, want %q, %v", tt.uri, id, ok, tt.wantID, tt.wantOK)
+		}
+	}
+}
+
+func TestEpisodeIDFromURI(t *testing.T) {
+	tests := []struct {
+		uri    string
+		wantID string
+		wantOK bool
+	}{
+		{uri: "spotify:episode:512ojhOuo1ktJprKbVcKyQ", wantID: "512ojhOuo1ktJprKbVcKyQ", wantOK: true},
+		{uri: "spotify:track:4uLU6hMCjMI75M1A2tKUQC"},
+		{uri: "spotify:episode:"},
+		{uri: "spotify:episode:a:b"},
+		{uri: "episode:512ojhOuo1ktJprKbVcKyQ"},
+	}
+
+	for _, tt := range tests {
+		id, ok := EpisodeIDFromURI(&tt.uri)
+		if id != tt.wantID || ok != tt.wantOK {
+			t.Errorf("EpisodeIDFromURI(%q) = %q, %v, want %q, %v", tt.uri, id, ok, tt.wantID, tt.wantOK)
+		}
+	}
+	if id, ok := EpisodeIDFromURI(nil); id != "" || ok {
+		t.Errorf("EpisodeIDFromURI(nil) = %q, %v, want \"\", false", id, ok)
+	}
+}
+
+func TestAddArtworksMixedBatch(t *testing.T) {
+	client := &fakeClient{tracks: map[spotify.ID]*spotify.FullTrack{
+		"a": fakeTrack("a", "https://i.scdn.co/image/a"),
+		"c": fakeTrack("c", "https://i.scdn.co/image/c"),
+	}}
+	allStreams := trackStreams("a", "b", "c", "d", "a")
+
+	result := AddArtworks(context.Background(), allStreams, ArtworkOptions{
+		Client: func() TrackFetcher { return client },
+		Logger: testLogger{t},
+	})
+
+	wantURLs := []string{"https://i.scdn.co/image/a", "", "https://i.scdn.co/image/c", "", "https://i.scdn.co/image/a"}
+	for i, want := range wantURLs {
+		got := ""
+		if allStreams[i].ArtworkURL != nil {
+			got = *allStreams[i].ArtworkURL
+		}
+		if got != want {
+			t.Errorf("stream %d artwork = %q, want %q", i, got, want)
+		}
+	}
+
+	failed := make([]string, len(result.Failed))
+	for i, trackID := range result.Failed {
+		failed[i] = string(trackID)
+	}
+	sort.Strings(failed)
+	if len(failed) != 2 || failed[0] != "b" || failed[1] != "d" {
+		t.Errorf("Failed = %v, want [b d]", failed)
+	}
+	if client.trackRequests != 1 {
+		t.Errorf("sent %d track requests, want 1 batch", client.trackRequests)
+	}
+}
+
+func TestAddArtworksFailFastOnNullTrack(t *testing.T) {
+	client := &fakeClient{tracks: map[spotify.ID]*spotify.FullTrack{
+		"a": fakeTrack("a", "https://i.scdn.co/image/a"),
+	}}
+
+	result := AddArtworks(context.Background(), trackStreams("a", "b"), ArtworkOptions{
+		Client:   func() TrackFetcher { return client },
+		FailFast: true,
+		Logger:   testLogger{t},
+	})
+
+	if result.Err == nil {
+		t.Fatal("Err = nil, want the unresolved track")
+	}
+	if len(result.Failed) != 0 {
+		t.Errorf("Failed = %v, want none with FailFast", result.Failed)
+	}
+}
+
+// blockingClient serves its first track request, then blocks the following
+// ones until their context is done.
+type blockingClient struct {
+	fakeClient
+	// blocked is closed once a request blocks.
+	blocked chan struct{}
+	once    sync.Once
+}
+
+func (c *blockingClient) GetTracks(ctx context.Context, ids []spotify.ID, opts ...spotify.RequestOption) ([]*spotify.FullTrack, error) {
+	c.mu.Lock()
+	first := c.trackRequests == 0
+	c.mu.Unlock()
+	if first {
+		return c.fakeClient.GetTracks(ctx, ids, opts...)
+	}
+
+	c.once.Do(func() { close(c.blocked) })
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestAddArtworksCancelled(t *testing.T) {
+	client := &blockingClient{
+		fakeClient: fakeClient{tracks: make(map[spotify.ID]*spotify.FullTrack)},
+		blocked:    make(chan struct{}),
+	}
+	var trackIDs []string
+	for i := 0; i < MaxTracksPerRequest+10; i++ {
+		trackID := fmt.Sprintf("t%02d", i)
+		trackIDs = append(trackIDs, trackID)
+		client.tracks[spotify.ID(trackID)] = fakeTrack(spotify.ID(trackID), "https://i.scdn.co/image/"+trackID)
+	}
+	allStreams := trackStreams(trackIDs...)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-client.blocked
+		cancel()
+	}()
+	result := AddArtworks(ctx, allStreams, ArtworkOptions{
+		Client:  func() TrackFetcher { return client },
+		Workers: 1,
+		Logger:  testLogger{t},
+	})
+
+	if result.Err != nil {
+		t.Errorf("Err = %v, want nil when cancelled", result.Err)
+	}
+	if len(result.Failed) != 0 {
+		t.Errorf("Failed = %v, want none when cancelled", result.Failed)
+	}
+	if len(result.ArtworkByID) != MaxTracksPerRequest {
+		t.Errorf("resolved %d artworks, want the %d of the first batch", len(result.ArtworkByID), MaxTracksPerRequest)
+	}
+	for i, s := range allStreams {
+		resolved := i < MaxTracksPerRequest
+		if got := s.ArtworkURL != nil; got != resolved {
+			t.Errorf("stream %d has artwork = %v, want %v", i, got, resolved)
+			continue
+		}
+		if resolved && *s.ArtworkURL != "https://i.scdn.co/image/"+trackIDs[i] {
+			t.Errorf("stream %d artwork = %q, want that of %s", i, *s.ArtworkURL, trackIDs[i])
+		}
+	}
+}
+
+// offlineEpisodeClient fails its first episode request with a network error.
+type offlineEpisodeClient struct {
+	fakeClient
+	episodeRequests int
+}
+
+func (c *offlineEpisodeClient) GetEpisode(ctx context.Context, id string, opts ...spotify.RequestOption) (*spotify.EpisodePage, error) {
+	c.episodeRequests++
+	if c.episodeRequests == 1 {
+		return nil, &net.OpError{Op: "dial", Net: "tcp", Err: fmt.Errorf("network is unreachable")}
+	}
+	return &spotify.EpisodePage{Images: []spotify.Image{{URL: "https://i.scdn.co/image/" + id, Width: 640, Height: 640}}}, nil
+}
+
+func TestAddArtworksRetriesEpisodesOffline(t *testing.T) {
+	client := &offlineEpisodeClient{}
+	episodeURI := "spotify:episode:e"
+	allStreams := []Stream{{SpotifyEpisodeURI: &episodeURI}}
+
+	result := AddArtworks(context.Background(), allStreams, ArtworkOptions{
+		Client:         func() TrackFetcher { return client },
+		OfflineTimeout: time.Minute,
+		Logger:         testLogger{t},
+	})
+
+	if len(result.FailedEpisodes) != 0 {
+		t.Fatalf("FailedEpisodes = %v, want the episode retried", result.FailedEpisodes)
+	}
+	if allStreams[0].ArtworkURL == nil || *allStreams[0].ArtworkURL != "https://i.scdn.co/image/e" {
+		t.Errorf("artwork = %v, want that of the episode", allStreams[0].ArtworkURL)
+	}
+	if result.Requests != 2 {
+		t.Errorf("Requests = %d, want 2", result.Requests)
+	}
+}
+
+func TestAddArtworksBatches(t *testing.T) {
+	client := &fakeClient{tracks: make(map[spotify.ID]*spotify.FullTrack)}
+	var trackIDs []string
+	for i := 0; i < 2*MaxTracksPerRequest+1; i++ {
+		trackID := fmt.Sprintf("t%03d", i)
+		trackIDs = append(trackIDs, trackID)
+		client.tracks[spotify.ID(trackID)] = fakeTrack(spotify.ID(trackID), "https://i.scdn.co/image/"+trackID)
+	}
+	// Repeated tracks are only looked up once
+	allStreams := trackStreams(append(trackIDs, trackIDs[:10]...)...)
+
+	result := AddArtworks(context.Background(), allStreams, ArtworkOptions{
+		Client: func() TrackFetcher { return client },
+		Logger: testLogger{t},
+	})
+
+	if client.trackRequests != 3 {
+		t.Errorf("sent %d track requests, want 3 batches", client.trackRequests)
+	}
+	if len(client.requestedIDs) != len(trackIDs) {
+		t.Errorf("looked up %d track IDs, want %d", len(client.requestedIDs), len(trackIDs))
+	}
+	if result.Requests != 3 {
+		t.Errorf("Requests = %d, want 3", result.Requests)
+	}
+	for i, s := range allStreams {
+		if s.ArtworkURL == nil {
+			t.Errorf("stream %d has no artwork", i)
+		}
+	}
+}
+
+func TestAddArtworksRetriesFailedBatchPerTrack(t *testing.T) {
+	client := &fakeClient{
+		tracks: map[spotify.ID]*spotify.FullTrack{
+			"a": fakeTrack("a", "https://i.scdn.co/image/a"),
+			"b": fakeTrack("b", "https://i.scdn.co/image/b"),
+		},
+		failBatches: true,
+	}
+	allStreams := trackStreams("a", "b", "bad")
+
+	result := AddArtworks(context.Background(), allStreams, ArtworkOptions{
+		Client: func() TrackFetcher { return client },
+		Logger: testLogger{t},
+	})
+
+	if client.trackRequests != 4 {
+		t.Errorf("sent %d track requests, want the batch and then 3 single tracks", client.trackRequests)
+	}
+	if len(result.Failed) != 1 || result.Failed[0] != "bad" {
+		t.Errorf("Failed = %v, want [bad]", result.Failed)
+	}
+	if allStreams[0].ArtworkURL == nil || allStreams[1].ArtworkURL == nil {
+		t.Error("the valid tracks of the failed batch have no artwork")
+	}
+}
+
+func TestAddArtworksUsesKnownArtworks(t *testing.T) {
+	client := &fakeClient{tracks: map[spotify.ID]*spotify.FullTrack{
+		"b": fakeTrack("b", "https://i.scdn.co/image/b"),
+	}}
+	allStreams := trackStreams("a", "b")
+
+	var fetched []string
+	result := AddArtworks(context.Background(), allStreams, ArtworkOptions{
+		Client:  func() TrackFetcher { return client },
+		Known:   map[string]Artwork{"a": {URL: "https://i.scdn.co/image/cached"}},
+		OnTrack: func(trackID string, artwork Artwork) { fetched = append(fetched, trackID) },
+		Logger:  testLogger{t},
+	})
+
+	if len(client.requestedIDs) != 1 || client.requestedIDs[0] != "b" {
+		t.Errorf("looked up %v, want only [b]", client.requestedIDs)
+	}
+	if *allStreams[0].ArtworkURL != "https://i.scdn.co/image/cached" {
+		t.Errorf("artwork = %q, want the known one", *allStreams[0].ArtworkURL)
+	}
+	if len(fetched) != 1 || fetched[0] != "b" {
+		t.Errorf("OnTrack called for %v, want [b]", fetched)
+	}
+	if result.CacheHits != 1 {
+		t.Errorf("CacheHits = %d, want 1", result.CacheHits)
+	}
+}
+
+func TestAddArtworksKeepsExistingArtwork(t *testing.T) {
+	client := &fakeClient{tracks: map[spotify.ID]*spotify.FullTrack{
+		"a": fakeTrack("a", "https://i.scdn.co/image/a"),
+	}}
+	allStreams := trackStreams("a", "a")
+	edited := "https://example.com/edited.jpg"
+	allStreams[0].ArtworkURL = &edited
+
+	result := AddArtworks(context.Background(), allStreams, ArtworkOptions{
+		Client: func() TrackFetcher { return client },
+		Logger: testLogger{t},
+	})
+
+	if *allStreams[0].ArtworkURL != edited {
+		t.Errorf("artwork = %q, want the existing %q", *allStreams[0].ArtworkURL, edited)
+	}
+	if *allStreams[1].ArtworkURL != "https://i.scdn.co/image/a" {
+		t.Errorf("artwork = %q, want the fetched one", *allStreams[1].ArtworkURL)
+	}
+	if result.AlreadySet != 1 {
+		t.Errorf("AlreadySet = %d, want 1", result.AlreadySet)
+	}
+}
+
+func TestAddArtworksWithoutClient(t *testing.T) {
+	allStreams := trackStreams("a", "b")
+
+	result := AddArtworks(context.Background(), allStreams, ArtworkOptions{
+		Known:  map[string]Artwork{"a": {URL: "https://i.scdn.co/image/a"}},
+		Logger: testLogger{t},
+	})
+
+	if result.Err == nil {
+		t.Error("Err = nil, want the missing client")
+	}
+	if allStreams[0].ArtworkURL == nil || allStreams[1].ArtworkURL != nil {
+		t.Error("want only the known artwork added")
+	}
+}
+
+func TestAddArtworksConcurrentWorkers(t *testing.T) {
+	client := &fakeClient{tracks: make(map[spotify.ID]*spotify.FullTrack)}
+	var trackIDs []string
+	for i := 0; i < 8*MaxTracksPerRequest; i++ {
+		trackID := fmt.Sprintf("t%03d", i)
+		trackIDs = append(trackIDs, trackID)
+		if i%7 != 0 {
+			client.tracks[spotify.ID(trackID)] = fakeTrack(spotify.ID(trackID), "https://i.scdn.co/image/"+trackID)
+		}
+	}
+	allStreams := trackStreams(trackIDs...)
+
+	var mu sync.Mutex
+	fetched := make(map[string]bool)
+	result := AddArtworks(context.Background(), allStreams, ArtworkOptions{
+		Client:  func() TrackFetcher { return client },
+		Workers: 4,
+		OnTrack: func(trackID string, artwork Artwork) {
+			mu.Lock()
+			defer mu.Unlock()
+			fetched[trackID] = true
+		},
+		Logger: testLogger{t},
+	})
+
+	if client.trackRequests != 8 {
+		t.Errorf("sent %d track requests, want 8 batches", client.trackRequests)
+	}
+	if len(fetched) != len(client.tracks) || len(result.ArtworkByID) != len(client.tracks) {
+		t.Errorf("fetched %d and resolved %d artworks, want %d", len(fetched), len(result.ArtworkByID), len(client.tracks))
+	}
+	if len(result.Failed) != len(trackIDs)-len(client.tracks) {
+		t.Errorf("%d tracks failed, want %d", len(result.Failed), len(trackIDs)-len(client.tracks))
+	}
+	for i, s := range allStreams {
+		if got, want := s.ArtworkURL != nil, i%7 != 0; got != want {
+			t.Errorf("stream %d has artwork = %v, want %v", i, got, want)
+		}
+	}
+}
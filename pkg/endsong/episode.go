@@ -0,0 +1,79 @@
+package endsong
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// defaultEpisodeMarket is the market episodes are looked up in when none is
+// set: without one, the API considers episodes unavailable to client
+// credentials.
+const defaultEpisodeMarket = "US"
+
+// EpisodeIDFromURI returns the ID of a "spotify:episode:<id>" URI.
+func EpisodeIDFromURI(uri *string) (string, bool) {
+	if uri == nil {
+		return "", false
+	}
+	id, kind, ok := parseTrackID(*uri)
+	if !ok || kind != "episode" {
+		return "", false
+	}
+	return id, true
+}
+
+// episodeArtwork looks up an episode and returns its artwork. Failures are
+// logged and reported as not ok.
+func (f fetcher) episodeArtwork(ctx context.Context, episodeID string) (Artwork, bool) {
+	market := f.market
+	if market == "" {
+		market = defaultEpisodeMarket
+	}
+
+	var episode *spotify.EpisodePage
+	err := f.retryOffline(ctx, func(ctx context.Context) error {
+		var err error
+		episode, err = f.client.GetEpisode(ctx, episodeID, spotify.Market(market))
+		return err
+	})
+	if err != nil && ctx.Err() != nil {
+		return Artwork{}, false
+	}
+	if err != nil && f.failFast != nil {
+		f.failFast(fmt.Errorf("getting Spotify episode %s: %w", episodeID, err))
+		return Artwork{}, false
+	}
+	if isTimeout(ctx, err) {
+		f.logger.Warnf("Timed out after %s when getting Spotify episode %s.", f.requestTimeout, episodeID)
+		return Artwork{}, false
+	}
+	if err != nil {
+		f.logger.Warnf("Error when getting Spotify episode %s: %v", episodeID, err)
+		return Artwork{}, false
+	}
+	if len(episode.Images) == 0 {
+		f.logger.Warnf("No artwork for %q (%s).", episode.Name, episodeID)
+		return Artwork{}, false
+	}
+
+	image := selectImage(episode.Images, f.imageSize, spotify.ID(episodeID), f.logger)
+	return Artwork{URL: image.URL, ReleaseDate: episode.ReleaseDate, ImageSize: f.imageSize}, true
+}
+
+// episodeResult is the outcome of looking up one episode.
+type episodeResult struct {
+	episodeID string
+	artwork   Artwork
+	ok        bool
+}
+
+// episodeArtworksConcurrently looks up the episodes one at a time, as the API
+// has no batched episode lookup, with workers concurrent lookups, see runPool.
+func (f fetcher) episodeArtworksConcurrently(ctx context.Context, episodeIDs []string, workers int) <-chan episodeResult {
+	return runPool(ctx, episodeIDs, workers, func(episodeID string) episodeResult {
+		artwork, ok := f.episodeArtwork(ctx, episodeID)
+		return episodeResult{episodeID: episodeID, artwork: artwork, ok: ok}
+	})
+}
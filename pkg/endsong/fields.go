@@ -0,0 +1,100 @@
+package endsong
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// StreamFieldNames returns the JSON names of the Stream fields.
+func StreamFieldNames() []string {
+	var names []string
+	t := reflect.TypeOf(Stream{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		names = append(names, name)
+	}
+	return names
+}
+
+// ParseFields parses a comma separated list of Stream field names, rejecting
+// names that aren't Stream fields.
+func ParseFields(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+
+	valid := make(map[string]bool)
+	for _, name := range StreamFieldNames() {
+		valid[name] = true
+	}
+
+	var fields []string
+	for _, field := range strings.Split(list, ",") {
+		field = strings.TrimSpace(field)
+		if !valid[field] {
+			return nil, fmt.Errorf("unknown field %q: must be among %s", field, strings.Join(StreamFieldNames(), ", "))
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// projectedStream is a stream encoded with only some of its fields, in the
+// given order, or all of them when fields is empty, and with the artwork URL
+// under the artworkField key unless it's empty.
+type projectedStream struct {
+	stream       Stream
+	fields       []string
+	artworkField string
+}
+
+func (p projectedStream) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(p.stream); err != nil {
+		return nil, err
+	}
+	var values map[string]json.RawMessage
+	if err := json.Unmarshal(buf.Bytes(), &values); err != nil {
+		return nil, err
+	}
+
+	// All fields are written as usual, leaving out the omitted ones, while
+	// selected fields are written as null when omitted
+	fields := p.fields
+	all := len(fields) == 0
+	if all {
+		fields = StreamFieldNames()
+	}
+
+	buf.Reset()
+	buf.WriteByte('{')
+	first := true
+	for _, field := range fields {
+		value, ok := values[field]
+		if !ok && all {
+			continue
+		}
+		if !ok {
+			value = json.RawMessage("null")
+		}
+		if !first {
+			buf.WriteByte(',')
+		}
+		first = false
+		name := field
+		if field == ArtworkField && p.artworkField != "" {
+			name = p.artworkField
+		}
+		key, _ := json.Marshal(name)
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,40 @@
+package endsong
+
+import (
+	"github.com/zmb3/spotify/v2"
+)
+
+// ImageWidths are the artwork widths in pixels of each image size keyword,
+// matching the sizes Spotify returns album covers in.
+var ImageWidths = map[string]spotify.Numeric{
+	"small":  64,
+	"medium": 300,
+	"large":  640,
+}
+
+// selectImage returns the image of the requested size among images, which
+// must not be empty. When that size isn't available, it falls back to the
+// closest width and logs it. Images without a known width are only picked
+// when none has one, as Spotify lists images largest first.
+func selectImage(images []spotify.Image, size string, id spotify.ID, logger Logger) spotify.Image {
+	width := ImageWidths[size]
+
+	best := images[0]
+	for _, image := range images[1:] {
+		if best.Width == 0 || image.Width != 0 && abs(image.Width-width) < abs(best.Width-width) {
+			best = image
+		}
+	}
+	if best.Width != 0 && best.Width != width {
+		logger.Warnf("No %dpx artwork for %s, using %dpx.", width, id, best.Width)
+	}
+
+	return best
+}
+
+func abs(n spotify.Numeric) spotify.Numeric {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
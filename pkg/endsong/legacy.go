@@ -0,0 +1,76 @@
+package endsong
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// legacyEndTimeLayout is the layout of the endTime field of the legacy
+// streaming history, in UTC and to the minute.
+const legacyEndTimeLayout = "2006-01-02 15:04"
+
+// legacyFields are the fields of the streaming history files of older exports
+// and of the account data export (StreamingHistory*.json), which predate the
+// extended streaming history. They have no URIs.
+type legacyFields struct {
+	EndTime     string `json:"endTime"`
+	ArtistName  string `json:"artistName"`
+	TrackName   string `json:"trackName"`
+	PodcastName string `json:"podcastName"`
+	EpisodeName string `json:"episodeName"`
+	MSPlayed    int64  `json:"msPlayed"`
+}
+
+// UnmarshalJSON decodes s from either the extended streaming history layout or
+// the legacy one, whose fields are mapped to their current counterparts.
+func (s *Stream) UnmarshalJSON(data []byte) error {
+	// stream has the fields of Stream but not this method, so as not to
+	// recurse.
+	type stream Stream
+	var record struct {
+		stream
+		legacyFields
+	}
+	if err := json.Unmarshal(data, &record); err != nil {
+		return err
+	}
+
+	*s = Stream(record.stream)
+	return s.addLegacyFields(record.legacyFields)
+}
+
+// addLegacyFields sets the fields of s that are empty from their legacy
+// counterparts.
+func (s *Stream) addLegacyFields(legacy legacyFields) error {
+	if s.Ts.IsZero() && legacy.EndTime != "" {
+		ts, err := time.Parse(legacyEndTimeLayout, legacy.EndTime)
+		if err != nil {
+			return fmt.Errorf("invalid endTime %q: %w", legacy.EndTime, err)
+		}
+		s.Ts = ts
+	}
+	if s.MSPlayed == 0 {
+		s.MSPlayed = legacy.MSPlayed
+	}
+	if s.MasterMetadataTrackName == "" {
+		s.MasterMetadataTrackName = legacy.TrackName
+	}
+	if s.MasterMetadataAlbumArtistName == "" {
+		s.MasterMetadataAlbumArtistName = legacy.ArtistName
+	}
+	if s.EpisodeName == nil && legacy.EpisodeName != "" {
+		s.EpisodeName = &legacy.EpisodeName
+	}
+	if s.EpisodeShowName == nil && legacy.PodcastName != "" {
+		s.EpisodeShowName = &legacy.PodcastName
+	}
+	return nil
+}
+
+// isEmpty reports whether s has none of the fields that identify a stream,
+// as when decoding a file that isn't a streaming history.
+func (s Stream) isEmpty() bool {
+	return s.Ts.IsZero() && s.MSPlayed == 0 && s.SpotifyTrackURI == "" && s.SpotifyEpisodeURI == nil &&
+		s.MasterMetadataTrackName == "" && s.EpisodeName == nil
+}
@@ -0,0 +1,108 @@
+package endsong
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+)
+
+// decodeStreamsLenient decodes the streams array read from r one element at a
+// time like decodeStreams, but skips malformed elements instead of failing,
+// and returns how many were skipped.
+//
+// Elements are split on the commas between top-level values, tracking
+// nesting and strings, so a syntax error inside a record doesn't prevent
+// decoding the following ones.
+func decodeStreamsLenient(rd io.Reader) ([]Stream, int, error) {
+	var fileStreams []Stream
+	skipped := 0
+
+	r := bufio.NewReader(rd)
+
+	if err := skipToArrayStart(r); err != nil {
+		return nil, 0, err
+	}
+
+	var element []byte
+	flush := func() {
+		element = bytes.TrimSpace(element)
+		if len(element) > 0 {
+			var stream Stream
+			if err := json.Unmarshal(element, &stream); err != nil {
+				skipped++
+			} else {
+				fileStreams = append(fileStreams, stream)
+			}
+		}
+		element = element[:0]
+	}
+
+	depth := 0
+	inString, escaped := false, false
+	for {
+		c, err := r.ReadByte()
+		if err == io.EOF {
+			// Truncated file: keep what could be decoded
+			flush()
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+
+		if inString {
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			element = append(element, c)
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case '{', '[':
+			depth++
+		case '}', ']':
+			if depth == 0 {
+				// End of the streams array
+				flush()
+				return fileStreams, skipped, nil
+			}
+			depth--
+		case ',':
+			if depth == 0 {
+				flush()
+				continue
+			}
+		}
+		element = append(element, c)
+	}
+
+	return fileStreams, skipped, nil
+}
+
+// skipToArrayStart reads up to and including the opening bracket of the
+// top-level array.
+func skipToArrayStart(r *bufio.Reader) error {
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		switch c {
+		case '[':
+			return nil
+		case ' ', '\t', '\r', '\n':
+		default:
+			return errors.New("expected a JSON array of streams")
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package endsong
+
+import (
+	"log"
+)
+
+// Logger receives the messages of the pipeline.
+type Logger interface {
+	// Printf reports progress.
+	Printf(format string, a ...interface{})
+	// Warnf reports a problem that doesn't stop the pipeline, such as a
+	// failed lookup.
+	Warnf(format string, a ...interface{})
+}
+
+// stdLogger is the Logger used when none is given, writing to the standard
+// logger.
+type stdLogger struct{}
+
+func (stdLogger) Printf(format string, a ...interface{}) { log.Printf(format, a...) }
+func (stdLogger) Warnf(format string, a ...interface{})  { log.Printf(format, a...) }
+
+// orDefault returns l, or the standard logger if l is nil.
+func orDefault(l Logger) Logger {
+	if l == nil {
+		return stdLogger{}
+	}
+	return l
+}
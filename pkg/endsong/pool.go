@@ -0,0 +1,44 @@
+package endsong
+
+import (
+	"context"
+	"sync"
+)
+
+// runPool calls do with each job, across as many goroutines as workers, and
+// sends each result on the returned channel, which is closed once all are
+// done. Once ctx is done, the jobs not started yet are dropped.
+func runPool[J, R any](ctx context.Context, jobs []J, workers int, do func(J) R) <-chan R {
+	if workers < 1 {
+		workers = 1
+	}
+
+	pending := make(chan J)
+	results := make(chan R)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range pending {
+				results <- do(job)
+			}
+		}()
+	}
+
+	go func() {
+	feed:
+		for _, job := range jobs {
+			select {
+			case pending <- job:
+			case <-ctx.Done():
+				break feed
+			}
+		}
+		close(pending)
+		wg.Wait()
+		close(results)
+	}()
+
+	return results
+}
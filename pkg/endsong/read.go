@@ -0,0 +1,219 @@
+package endsong
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FindFiles returns the paths of the streaming history files in dir, in
+// filename order: the files matching pattern, a filepath.Match pattern, or by
+// default the JSON files named like Spotify exports.
+func FindFiles(dir, pattern string) ([]string, error) {
+	var fileNames []string
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range files {
+		if f.IsDir() {
+			continue
+		}
+		matched, err := matchFileName(f.Name(), pattern)
+		if err != nil {
+			return nil, err
+		}
+		if matched {
+			fileNames = append(fileNames, filepath.Join(dir, f.Name()))
+		}
+	}
+
+	return fileNames, nil
+}
+
+// matchFileName reports whether fileName, a base name, is a streaming history
+// file as FindFiles selects them.
+func matchFileName(fileName, pattern string) (bool, error) {
+	if pattern != "" {
+		return filepath.Match(pattern, fileName)
+	}
+
+	if !strings.HasSuffix(fileName, ".json") {
+		return false, nil
+	}
+
+	return strings.HasPrefix(fileName, "endsong_") || strings.HasPrefix(fileName, "Streaming_History_Audio_"), nil
+}
+
+// IsZip reports whether fileName is a zip archive, judging by its extension.
+func IsZip(fileName string) bool {
+	return strings.EqualFold(filepath.Ext(fileName), ".zip")
+}
+
+// FileStats is what an input file contributed.
+type FileStats struct {
+	FileName string `json:"file_name"`
+	Streams  int    `json:"streams"`
+	MSPlayed int64  `json:"ms_played"`
+}
+
+// ReadOptions configures ReadFiles.
+type ReadOptions struct {
+	// Lenient skips malformed records instead of failing on the whole file.
+	Lenient bool
+	// OnFile, if set, is called after each file is read.
+	OnFile func(FileStats)
+	// Pattern selects the entries read from zip archives, like FindFiles'
+	// pattern.
+	Pattern string
+	Logger  Logger
+}
+
+// ReadFiles reads the streams of the given files, in order, along with what
+// each file contributed. Files are decoded one record at a time, so their
+// content is never held in memory all at once.
+//
+// A zip archive, such as the export Spotify sends, is read in place: its
+// entries selected by opts.Pattern are decoded in archive order, each
+// reported as a file named after the archive and the entry.
+func ReadFiles(fileNames []string, opts ReadOptions) ([]Stream, []FileStats, error) {
+	logger := orDefault(opts.Logger)
+	var allStreams []Stream
+	var allFileStats []FileStats
+
+	read := func(fileName string, r io.Reader) error {
+		var fileStreams []Stream
+
+		var err error
+		if opts.Lenient {
+			var skipped int
+			fileStreams, skipped, err = decodeStreamsLenient(r)
+			if skipped > 0 {
+				logger.Warnf("%s: skipped %d malformed records.", fileName, skipped)
+			}
+		} else {
+			fileStreams, err = decodeStreams(r)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", fileName, err)
+		}
+		if allEmpty(fileStreams) {
+			logger.Warnf("%s: none of the %d records has a known field, is it a Spotify streaming history file?", fileName, len(fileStreams))
+		}
+
+		allStreams = append(allStreams, fileStreams...)
+
+		fileStats := FileStats{FileName: fileName, Streams: len(fileStreams)}
+		for _, s := range fileStreams {
+			fileStats.MSPlayed += s.MSPlayed
+		}
+		allFileStats = append(allFileStats, fileStats)
+
+		if opts.OnFile != nil {
+			opts.OnFile(fileStats)
+		}
+		return nil
+	}
+
+	for _, fileName := range fileNames {
+		var err error
+		if IsZip(fileName) {
+			err = readZip(fileName, opts.Pattern, read)
+		} else {
+			err = readFile(fileName, read)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return allStreams, allFileStats, nil
+}
+
+// readFile calls read with the content of fileName.
+func readFile(fileName string, read func(string, io.Reader) error) error {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", fileName, err)
+	}
+	defer f.Close()
+
+	return read(fileName, f)
+}
+
+// readZip calls read with the content of each entry of the zip archive
+// zipName whose base name matches pattern, decompressing it on the fly.
+func readZip(zipName, pattern string, read func(string, io.Reader) error) error {
+	zr, err := zip.OpenReader(zipName)
+	if err != nil {
+		return fmt.Errorf("%s: %w", zipName, err)
+	}
+	defer zr.Close()
+
+	for _, entry := range zr.File {
+		if entry.FileInfo().IsDir() {
+			continue
+		}
+		matched, err := matchFileName(path.Base(entry.Name), pattern)
+		if err != nil {
+			return err
+		}
+		if !matched {
+			continue
+		}
+
+		entryName := filepath.Join(zipName, filepath.FromSlash(entry.Name))
+		rc, err := entry.Open()
+		if err != nil {
+			return fmt.Errorf("%s: %w", entryName, err)
+		}
+		err = read(entryName, rc)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// allEmpty reports whether there are streams and all of them are empty.
+func allEmpty(streams []Stream) bool {
+	for _, s := range streams {
+		if !s.isEmpty() {
+			return false
+		}
+	}
+	return len(streams) > 0
+}
+
+// decodeStreams decodes the streams array read from r one element at a time,
+// so that peak memory is bounded by the decoder buffer rather than the file
+// size.
+func decodeStreams(r io.Reader) ([]Stream, error) {
+	var fileStreams []Stream
+
+	dec := json.NewDecoder(r)
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	for dec.More() {
+		var stream Stream
+		if err := dec.Decode(&stream); err != nil {
+			return nil, err
+		}
+		fileStreams = append(fileStreams, stream)
+	}
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+
+	return fileStreams, nil
+}
@@ -0,0 +1,115 @@
+package endsong
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+
+	"github.com/zmb3/spotify/v2"
+)
+
+// maxOfflineBackoff caps the wait between retries while the network is down.
+const maxOfflineBackoff = time.Minute
+
+// isNetworkError reports whether err is a connectivity failure: a failed
+// dial, DNS lookup, read or write, a timeout, or a connection reset or closed
+// mid-response. Other transport errors, such as TLS failures or a token that
+// can't be renewed, aren't retried, even though the client wraps them all in a
+// *url.Error, which is a net.Error too.
+func isNetworkError(err error) bool {
+	var opErr *net.OpError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &opErr), errors.As(err, &dnsErr):
+		return true
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return true
+	case errors.Is(err, syscall.ECONNRESET), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, io.EOF):
+		return true
+	}
+	return false
+}
+
+// isRateLimited reports whether err is a 429 Too Many Requests, i.e. once the
+// retries of the client, if any, were exhausted.
+func isRateLimited(err error) bool {
+	var spotifyErr spotify.Error
+	return errors.As(err, &spotifyErr) && spotifyErr.Status == http.StatusTooManyRequests
+}
+
+// withTimeout returns ctx bounded by the request timeout of f, if any.
+func (f fetcher) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if f.requestTimeout <= 0 {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, f.requestTimeout)
+}
+
+// isTimeout reports whether err is a request that timed out while ctx, the
+// context of the whole lookup, is still live.
+func isTimeout(ctx context.Context, err error) bool {
+	return ctx.Err() == nil && errors.Is(err, context.DeadlineExceeded)
+}
+
+// getTracks calls GetTracks, retrying it while the network is unreachable,
+// see retryOffline.
+func (f fetcher) getTracks(ctx context.Context, trackIDs []spotify.ID) ([]*spotify.FullTrack, error) {
+	var opts []spotify.RequestOption
+	if f.market != "" {
+		opts = append(opts, spotify.Market(f.market))
+	}
+
+	var tracks []*spotify.FullTrack
+	err := f.retryOffline(ctx, func(ctx context.Context) error {
+		var err error
+		tracks, err = f.client.GetTracks(ctx, trackIDs, opts...)
+		return err
+	})
+	return tracks, err
+}
+
+// retryOffline sends a request, waiting with exponential backoff while the
+// network is unreachable or requests time out, instead of failing every
+// remaining lookup. It gives up once the network has been down for longer than
+// the offline timeout of f. Each attempt is bounded by the request timeout of
+// f and counted as a request.
+func (f fetcher) retryOffline(ctx context.Context, request func(ctx context.Context) error) error {
+	var offlineSince time.Time
+	backoff := time.Second
+	for {
+		reqCtx, cancel := f.withTimeout(ctx)
+		f.requests.Add(1)
+		err := request(reqCtx)
+		cancel()
+		if err == nil || ctx.Err() != nil || !isNetworkError(err) {
+			return err
+		}
+
+		if offlineSince.IsZero() {
+			offlineSince = time.Now()
+		} else if time.Since(offlineSince) > f.offlineTimeout {
+			return fmt.Errorf("network unreachable for %s: %w", f.offlineTimeout, err)
+		}
+
+		if isTimeout(ctx, err) {
+			f.logger.Warnf("Request timed out after %s, retrying in %s.", f.requestTimeout, backoff)
+		} else {
+			f.logger.Warnf("Network error, retrying in %s: %v", backoff, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		if backoff > maxOfflineBackoff {
+			backoff = maxOfflineBackoff
+		}
+	}
+}
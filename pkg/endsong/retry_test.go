@@ -0,0 +1,39 @@
+package endsong
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"net/url"
+	"syscall"
+	"testing"
+)
+
+func TestIsNetworkError(t *testing.T) {
+	urlError := func(err error) error {
+		return &url.Error{Op: "Get", URL: "https://api.spotify.com/v1/tracks", Err: err}
+	}
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "dial", err: urlError(&net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}), want: true},
+		{name: "dns", err: urlError(&net.DNSError{Err: "no such host", Name: "api.spotify.com"}), want: true},
+		{name: "timeout", err: urlError(context.DeadlineExceeded), want: true},
+		{name: "reset", err: urlError(syscall.ECONNRESET), want: true},
+		{name: "unexpected EOF", err: urlError(io.ErrUnexpectedEOF), want: true},
+		{name: "closed", err: urlError(io.EOF), want: true},
+		{name: "tls", err: urlError(x509.UnknownAuthorityError{})},
+		{name: "token", err: urlError(errors.New("oauth2: token expired and refresh token is not set"))},
+		{name: "api", err: errors.New("Spotify: invalid id [400]")},
+	}
+
+	for _, tt := range tests {
+		if got := isNetworkError(tt.err); got != tt.want {
+			t.Errorf("isNetworkError(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
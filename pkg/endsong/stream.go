@@ -0,0 +1,119 @@
+// Package endsong reads Spotify extended streaming history files ("endsong"
+// files) and adds the artwork of each streamed track or podcast episode.
+package endsong
+
+import (
+	"time"
+)
+
+// Artwork is the artwork resolved for a track.
+type Artwork struct {
+	AlbumID string `json:"album_id"`
+	URL     string `json:"artwork_url"`
+	// ReleaseDate is the album's release date, e.g. "1981-12" depending on its
+	// precision.
+	ReleaseDate string `json:"release_date,omitempty"`
+	// ImageSize is the image size keyword the artwork was resolved for, see
+	// ImageWidths. Empty means large, the only size before sizes existed.
+	ImageSize string `json:"image_size,omitempty"`
+	// Source is where the image comes from, see the ArtworkSource constants.
+	// Empty means the album, the only source before fallbacks existed.
+	Source string `json:"source,omitempty"`
+	// Metadata is the rest of what the track lookup returned. It's missing
+	// from artworks resolved before it existed.
+	Metadata *TrackMetadata `json:"metadata,omitempty"`
+}
+
+// TrackMetadata is the track metadata the export lacks, as returned along
+// with the artwork.
+type TrackMetadata struct {
+	DurationMS  int  `json:"duration_ms"`
+	Popularity  int  `json:"popularity"`
+	Explicit    bool `json:"explicit"`
+	TrackNumber int  `json:"track_number"`
+	DiscNumber  int  `json:"disc_number"`
+}
+
+// Where an artwork's image comes from.
+const (
+	ArtworkSourceAlbum   = "album"
+	ArtworkSourceEpisode = "episode"
+	// ArtworkSourceArtist is the image of the track's primary artist, used
+	// when its album has none.
+	ArtworkSourceArtist = "artist"
+)
+
+// Size returns the image size keyword the artwork was resolved for.
+func (a Artwork) Size() string {
+	if a.ImageSize == "" {
+		return "large"
+	}
+	return a.ImageSize
+}
+
+// Stream is a record of a streaming history file, along with what the
+// pipeline adds to it.
+type Stream struct {
+	Ts                            time.Time   `json:"ts"`
+	Username                      string      `json:"username"`
+	Platform                      string      `json:"platform"`
+	MSPlayed                      int64       `json:"ms_played"`
+	ConnCountry                   string      `json:"conn_country"`
+	IPAddrDecrypted               string      `json:"ip_addr_decrypted"`
+	UserAgentDecrypted            *string     `json:"user_agent_decrypted"`
+	MasterMetadataTrackName       string      `json:"master_metadata_track_name"`
+	MasterMetadataAlbumArtistName string      `json:"master_metadata_album_artist_name"`
+	MasterMetadataAlbumAlbumName  string      `json:"master_metadata_album_album_name"`
+	SpotifyTrackURI               string      `json:"spotify_track_uri"`
+	EpisodeName                   *string     `json:"episode_name"`
+	EpisodeShowName               *string     `json:"episode_show_name"`
+	SpotifyEpisodeURI             *string     `json:"spotify_episode_uri"`
+	ReasonStart                   ReasonStart `json:"reason_start"`
+	ReasonEnd                     ReasonEnd   `json:"reason_end"`
+	Shuffle                       bool        `json:"shuffle"`
+	Skipped                       *bool       `json:"skipped"`
+	Offline                       bool        `json:"offline"`
+	OfflineTimestamp              int64       `json:"offline_timestamp"`
+	IncognitoMode                 bool        `json:"incognito_mode"`
+
+	StreamID          string  `json:"stream_id,omitempty"`
+	GapFromPreviousMS *int64  `json:"gap_from_previous_ms,omitempty"`
+	ArtworkURL        *string `json:"artwork_url"`
+	ArtworkSource     string  `json:"artwork_source,omitempty"`
+
+	// Track metadata, only set when enriched, see ArtworkOptions.
+	TrackDurationMS  *int    `json:"track_duration_ms,omitempty"`
+	TrackPopularity  *int    `json:"track_popularity,omitempty"`
+	Explicit         *bool   `json:"explicit,omitempty"`
+	AlbumReleaseDate *string `json:"album_release_date,omitempty"`
+	TrackNumber      *int    `json:"track_number,omitempty"`
+	DiscNumber       *int    `json:"disc_number,omitempty"`
+}
+
+type ReasonStart string
+
+const (
+	Appload               ReasonStart = "appload"
+	Clickrow              ReasonStart = "clickrow"
+	Playbtn               ReasonStart = "playbtn"
+	ReasonStartBackbtn    ReasonStart = "backbtn"
+	ReasonStartFwdbtn     ReasonStart = "fwdbtn"
+	ReasonStartRemote     ReasonStart = "remote"
+	ReasonStartTrackdone  ReasonStart = "trackdone"
+	ReasonStartTrackerror ReasonStart = "trackerror"
+)
+
+type ReasonEnd string
+
+const (
+	Endplay                   ReasonEnd = "endplay"
+	Logout                    ReasonEnd = "logout"
+	ReasonEndBackbtn          ReasonEnd = "backbtn"
+	ReasonEndFwdbtn           ReasonEnd = "fwdbtn"
+	ReasonEndRemote           ReasonEnd = "remote"
+	ReasonEndTrackdone        ReasonEnd = "trackdone"
+	ReasonEndTrackerror       ReasonEnd = "trackerror"
+	UnexpectedExit            ReasonEnd = "unexpected-exit"
+	UnexpectedExitWhilePaused ReasonEnd = "unexpected-exit-while-paused"
+	Unknown                   ReasonEnd = "unknown"
+)
@@ -0,0 +1,65 @@
+package endsong
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// ArtworkField is the JSON name of the artwork URL field of Stream.
+const ArtworkField = "artwork_url"
+
+// WriteOptions configures WriteJSON and WriteNDJSON.
+type WriteOptions struct {
+	// Fields, if set, are the only fields written, in that order.
+	Fields []string
+	// ArtworkField, if set, is the key the artwork URL is written under
+	// instead of ArtworkField.
+	ArtworkField string
+	// Compact writes the JSON array of WriteJSON without indentation.
+	Compact bool
+}
+
+// projects reports whether streams are encoded through projectedStream.
+func (opts WriteOptions) projects() bool {
+	return len(opts.Fields) > 0 || (opts.ArtworkField != "" && opts.ArtworkField != ArtworkField)
+}
+
+// project returns what s is encoded as.
+func (opts WriteOptions) project(s Stream) interface{} {
+	if !opts.projects() {
+		return s
+	}
+	return projectedStream{stream: s, fields: opts.Fields, artworkField: opts.ArtworkField}
+}
+
+// WriteJSON writes the streams to w as an indented JSON array, or a compact
+// one with opts.Compact.
+func WriteJSON(w io.Writer, allStreams []Stream, opts WriteOptions) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if !opts.Compact {
+		enc.SetIndent("", "    ")
+	}
+	var v interface{} = allStreams
+	if opts.projects() {
+		projected := make([]interface{}, len(allStreams))
+		for i, s := range allStreams {
+			projected[i] = opts.project(s)
+		}
+		v = projected
+	}
+	return enc.Encode(v)
+}
+
+// WriteNDJSON writes the streams to w as newline-delimited JSON, one compact
+// object per line.
+func WriteNDJSON(w io.Writer, allStreams []Stream, opts WriteOptions) error {
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	for _, s := range allStreams {
+		if err := enc.Encode(opts.project(s)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
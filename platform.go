@@ -0,0 +1,37 @@
+package main
+
+import "strings"
+
+// platformPrefixes maps lowercase prefixes of the export's raw Platform values
+// (e.g. "Android OS 9 API 28 (samsung, SM-G960F)" or "web_player windows 10")
+// to a normalized platform.
+var platformPrefixes = []struct {
+	prefix   string
+	platform string
+}{
+	{"android", "mobile"},
+	{"ios", "mobile"},
+	{"windows", "desktop"},
+	{"os x", "desktop"},
+	{"osx", "desktop"},
+	{"macos", "desktop"},
+	{"linux", "desktop"},
+	{"web_player", "web"},
+	{"webplayer", "web"},
+	{"playstation", "console"},
+	{"xbox", "console"},
+	{"cast", "cast"},
+	{"partner", "partner"},
+}
+
+// normalizePlatform returns the normalized platform of a raw Platform value:
+// mobile, desktop, web, console, cast, partner, or other.
+func normalizePlatform(platform string) string {
+	platform = strings.ToLower(strings.TrimSpace(platform))
+	for _, p := range platformPrefixes {
+		if strings.HasPrefix(platform, p.prefix) {
+			return p.platform
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+// asciiTheme renders the progress bar without unicode block characters.
+var asciiTheme = progressbar.Theme{Saucer: "#", SaucerPadding: "-", BarStart: "[", BarEnd: "]"}
+
+// newProgressBar returns a bar like progressbar.Default, showing the lookup
+// rate and the estimated time remaining, with the width and theme set by
+// -progress-width and -progress-theme. With -quiet, the bar isn't drawn.
+func newProgressBar(max int64) *progressbar.ProgressBar {
+	if *quiet {
+		return progressbar.DefaultSilent(max)
+	}
+
+	options := []progressbar.Option{
+		progressbar.OptionSetWriter(os.Stderr),
+		progressbar.OptionThrottle(65 * time.Millisecond),
+		progressbar.OptionShowCount(),
+		progressbar.OptionShowIts(),
+		progressbar.OptionSetItsString("ids"),
+		progressbar.OptionSetPredictTime(true),
+		progressbar.OptionShowElapsedTimeOnFinish(),
+		progressbar.OptionOnCompletion(func() {
+			fmt.Fprint(os.Stderr, "\n")
+		}),
+		progressbar.OptionSetRenderBlankState(true),
+	}
+
+	if *progressWidth > 0 {
+		options = append(options, progressbar.OptionSetWidth(*progressWidth))
+	} else {
+		options = append(options, progressbar.OptionSetWidth(10), progressbar.OptionFullWidth())
+	}
+
+	if *progressTheme == "ascii" {
+		options = append(options, progressbar.OptionSetTheme(asciiTheme), progressbar.OptionSpinnerType(9))
+	} else {
+		options = append(options, progressbar.OptionSpinnerType(14))
+	}
+
+	return progressbar.NewOptions64(max, options...)
+}
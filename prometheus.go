@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+var prometheusLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// listeningMetrics are the values of the listening gauges for a set of streams.
+type listeningMetrics struct {
+	listeningSeconds float64
+	plays            int
+	skips            int
+	unknownSkips     int
+	uniqueTracks     int
+}
+
+func computeListeningMetrics(allStreams []endsong.Stream, keep func(endsong.Stream) bool) listeningMetrics {
+	var metrics listeningMetrics
+	tracks := make(map[string]bool)
+	for _, s := range allStreams {
+		if !keep(s) {
+			continue
+		}
+		metrics.listeningSeconds += float64(s.MSPlayed) / 1000
+		metrics.plays++
+		if skipped, known := streamSkipped(s); !known {
+			metrics.unknownSkips++
+		} else if skipped {
+			metrics.skips++
+		}
+		if s.SpotifyTrackURI != "" {
+			tracks[s.SpotifyTrackURI] = true
+		}
+	}
+	metrics.uniqueTracks = len(tracks)
+	return metrics
+}
+
+// writePrometheusFile writes listening gauges in the Prometheus text
+// exposition format, overall and labeled by artist for the topN artists only
+// to bound label cardinality.
+func writePrometheusFile(fileName string, allStreams []endsong.Stream, topN int) {
+	total := computeListeningMetrics(allStreams, func(endsong.Stream) bool { return true })
+
+	artists := topArtistsByMSPlayed(allStreams, topN)
+	byArtist := make([]listeningMetrics, len(artists))
+	for i, artist := range artists {
+		byArtist[i] = computeListeningMetrics(allStreams, func(s endsong.Stream) bool {
+			return s.MasterMetadataAlbumArtistName == artist
+		})
+	}
+
+	f, err := os.Create(fileName)
+	if err != nil {
+		fatal("Error when creating file: ", err)
+	}
+	defer f.Close()
+	w := bufio.NewWriter(f)
+
+	gauges := []struct {
+		name  string
+		help  string
+		value func(listeningMetrics) float64
+	}{
+		{"listening_seconds_total", "Total listening time in seconds.", func(m listeningMetrics) float64 { return m.listeningSeconds }},
+		{"plays_total", "Total number of streams.", func(m listeningMetrics) float64 { return float64(m.plays) }},
+		{"skips_total", "Number of skipped streams.", func(m listeningMetrics) float64 { return float64(m.skips) }},
+		{"unknown_skips_total", "Number of streams not known to be skipped or not.", func(m listeningMetrics) float64 { return float64(m.unknownSkips) }},
+		{"unique_tracks", "Number of distinct tracks streamed.", func(m listeningMetrics) float64 { return float64(m.uniqueTracks) }},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP spotify_%s %s\n", g.name, g.help)
+		fmt.Fprintf(w, "# TYPE spotify_%s gauge\n", g.name)
+		fmt.Fprintf(w, "spotify_%s %g\n", g.name, g.value(total))
+
+		fmt.Fprintf(w, "# HELP spotify_artist_%s %s By artist, for the top %d artists.\n", g.name, g.help, topN)
+		fmt.Fprintf(w, "# TYPE spotify_artist_%s gauge\n", g.name)
+		for i, artist := range artists {
+			fmt.Fprintf(w, "spotify_artist_%s{artist=\"%s\"} %g\n", g.name, prometheusLabelEscaper.Replace(artist), g.value(byArtist[i]))
+		}
+	}
+
+	if err := w.Flush(); err != nil {
+		fatal("Error when writing file: ", err)
+	}
+	printDone("%s written!", fileName)
+}
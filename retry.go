@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/clientcredentials"
+)
+
+// tokenAttempts is the number of attempts at getting a token before giving up
+// on transient errors.
+const tokenAttempts = 3
+
+// defaultRetryAfter is the wait after a 429 response without a usable
+// Retry-After header.
+const defaultRetryAfter = 5 * time.Second
+
+// getToken gets a token from config, retrying with increasing delays on
+// network errors and server errors, but not on rejected credentials.
+func getToken(ctx context.Context, config *clientcredentials.Config) (*oauth2.Token, error) {
+	delay := time.Second
+	for attempt := 1; ; attempt++ {
+		token, err := config.Token(ctx)
+		if err == nil || !isTransientTokenError(err) || attempt == tokenAttempts {
+			return token, err
+		}
+
+		printWarning("Error when getting token, retrying in %s (%d/%d): %v", delay, attempt, tokenAttempts-1, err)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// isTransientTokenError reports whether err is a connectivity failure or a
+// 5xx response of the token endpoint, which may succeed on retry.
+func isTransientTokenError(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var retrieveErr *oauth2.RetrieveError
+	return errors.As(err, &retrieveErr) && retrieveErr.Response != nil && retrieveErr.Response.StatusCode >= 500
+}
+
+// rateLimitRetries counts the requests resent by rateLimitTransport, which are
+// sent against the quota too but not counted by endsong.AddArtworks.
+var rateLimitRetries atomic.Int64
+
+// rateLimitTransport retries GET requests answered with 429 Too Many Requests,
+// waiting for the Retry-After duration plus some jitter, up to maxRetries
+// times. It is done at the transport level because spotify.Error doesn't carry
+// the Retry-After header.
+type rateLimitTransport struct {
+	base       http.RoundTripper
+	maxRetries int
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for retry := 0; ; retry++ {
+		resp, err := t.base.RoundTrip(req)
+		if err != nil || resp.StatusCode != http.StatusTooManyRequests || req.Method != http.MethodGet || retry >= t.maxRetries {
+			return resp, err
+		}
+		resp.Body.Close()
+
+		wait := retryAfter(resp)
+		wait += time.Duration(rand.Int63n(int64(wait/10) + int64(500*time.Millisecond)))
+		printWarning("Rate limited by Spotify, retrying in %s (%d/%d).", wait.Round(time.Millisecond), retry+1, t.maxRetries)
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		rateLimitRetries.Add(1)
+	}
+}
+
+// retryAfter returns the wait requested by the Retry-After header of resp,
+// given either in seconds or as an HTTP date.
+func retryAfter(resp *http.Response) time.Duration {
+	raw := resp.Header.Get("Retry-After")
+	if seconds, err := strconv.Atoi(raw); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(raw); err == nil {
+		if wait := time.Until(date); wait > 0 {
+			return wait
+		}
+		return 0
+	}
+	return defaultRetryAfter
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"time"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+// Why a stream got no artwork, as written to the -report-skipped file.
+const (
+	skippedLocalFile         = "local_file"
+	skippedNoURI             = "no_uri"
+	skippedInvalidURI        = "invalid_uri"
+	skippedTrackUnresolved   = "track_unresolved"
+	skippedNoImage           = "no_image"
+	skippedBelowPercentile   = "below_percentile"
+	skippedEpisodeUnresolved = "episode_unresolved"
+)
+
+// skippedStream is a stream without artwork in the -report-skipped file. The
+// track name and artist of an episode are its name and show.
+type skippedStream struct {
+	Ts         time.Time `json:"ts"`
+	URI        string    `json:"uri"`
+	TrackName  string    `json:"track_name"`
+	ArtistName string    `json:"artist_name"`
+	Reason     string    `json:"reason"`
+}
+
+// skippedStreams returns the streams that have no artwork after artworks were
+// added, in order, along with why.
+func skippedStreams(allStreams []endsong.Stream, artworks endsong.ArtworkResult) []skippedStream {
+	failed := make(map[string]bool)
+	for _, trackID := range artworks.Failed {
+		failed[string(trackID)] = true
+	}
+	noImage := make(map[string]bool)
+	for _, trackID := range artworks.NoImage {
+		noImage[string(trackID)] = true
+	}
+
+	skipped := []skippedStream{}
+	for _, s := range allStreams {
+		if s.HasArtwork() {
+			continue
+		}
+
+		entry := skippedStream{
+			Ts:         s.Ts,
+			URI:        s.SpotifyTrackURI,
+			TrackName:  s.MasterMetadataTrackName,
+			ArtistName: s.MasterMetadataAlbumArtistName,
+		}
+		if _, ok := endsong.EpisodeIDFromURI(s.SpotifyEpisodeURI); ok {
+			entry.URI = *s.SpotifyEpisodeURI
+			if s.EpisodeName != nil {
+				entry.TrackName = *s.EpisodeName
+			}
+			if s.EpisodeShowName != nil {
+				entry.ArtistName = *s.EpisodeShowName
+			}
+			entry.Reason = skippedEpisodeUnresolved
+			skipped = append(skipped, entry)
+			continue
+		}
+
+		trackID, isTrack := endsong.TrackIDFromURI(s.SpotifyTrackURI)
+		switch {
+		case endsong.IsLocalURI(s.SpotifyTrackURI):
+			entry.Reason = skippedLocalFile
+		case s.SpotifyTrackURI == "" && s.SpotifyEpisodeURI == nil:
+			entry.Reason = skippedNoURI
+		case !isTrack:
+			entry.Reason = skippedInvalidURI
+			if entry.URI == "" && s.SpotifyEpisodeURI != nil {
+				entry.URI = *s.SpotifyEpisodeURI
+			}
+		case failed[trackID]:
+			entry.Reason = skippedTrackUnresolved
+		case noImage[trackID] || *artworkPercentile <= 0:
+			entry.Reason = skippedNoImage
+		default:
+			entry.Reason = skippedBelowPercentile
+		}
+		skipped = append(skipped, entry)
+	}
+	return skipped
+}
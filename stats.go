@@ -0,0 +1,275 @@
+package main
+
+import (
+	"sort"
+	"time"
+
+	"github.com/imkh/spotify-endsong-artwork/pkg/endsong"
+)
+
+// Heatmap holds the total ms played indexed by [weekday][hour], in local time.
+// Weekdays follow time.Weekday, so index 0 is Sunday.
+type Heatmap [7][24]int64
+
+func computeHeatmap(allStreams []endsong.Stream) Heatmap {
+	var heatmap Heatmap
+	for _, s := range allStreams {
+		ts := s.Ts.In(time.Local)
+		heatmap[ts.Weekday()][ts.Hour()] += s.MSPlayed
+	}
+	return heatmap
+}
+
+// topArtistsByMSPlayed returns the n artists with the most ms played, most
+// played first. Streams without an artist (e.g. podcasts) are left out.
+func topArtistsByMSPlayed(allStreams []endsong.Stream, n int) []string {
+	msByArtist := make(map[string]int64)
+	for _, s := range allStreams {
+		if s.MasterMetadataAlbumArtistName != "" {
+			msByArtist[s.MasterMetadataAlbumArtistName] += s.MSPlayed
+		}
+	}
+
+	artists := make([]string, 0, len(msByArtist))
+	for artist := range msByArtist {
+		artists = append(artists, artist)
+	}
+	sort.Slice(artists, func(i, j int) bool {
+		if msByArtist[artists[i]] != msByArtist[artists[j]] {
+			return msByArtist[artists[i]] > msByArtist[artists[j]]
+		}
+		return artists[i] < artists[j]
+	})
+	if len(artists) > n {
+		artists = artists[:n]
+	}
+
+	return artists
+}
+
+// otherArtists is the artist trends bucket for artists outside the top N.
+const otherArtists = "Other"
+
+// ArtistTrend is the total ms played per artist for one month.
+type ArtistTrend struct {
+	Month    string           `json:"month"`
+	MSPlayed map[string]int64 `json:"ms_played"`
+}
+
+// computeArtistTrends buckets listening time by local month for the topN
+// artists by total ms played, with every other artist bucketed as "Other".
+// Streams without an artist (e.g. podcasts) are left out.
+func computeArtistTrends(allStreams []endsong.Stream, topN int) []ArtistTrend {
+	topArtists := make(map[string]bool)
+	for _, artist := range topArtistsByMSPlayed(allStreams, topN) {
+		topArtists[artist] = true
+	}
+
+	var trends []ArtistTrend
+	trendIndexByMonth := make(map[string]int)
+	for _, s := range allStreams {
+		artist := s.MasterMetadataAlbumArtistName
+		if artist == "" {
+			continue
+		}
+		if !topArtists[artist] {
+			artist = otherArtists
+		}
+
+		month := s.Ts.In(time.Local).Format("2006-01")
+		i, ok := trendIndexByMonth[month]
+		if !ok {
+			i = len(trends)
+			trends = append(trends, ArtistTrend{Month: month, MSPlayed: make(map[string]int64)})
+			trendIndexByMonth[month] = i
+		}
+		trends[i].MSPlayed[artist] += s.MSPlayed
+	}
+	sort.Slice(trends, func(i, j int) bool {
+		return trends[i].Month < trends[j].Month
+	})
+
+	return trends
+}
+
+// SessionStats summarizes listening sessions, a new session starting whenever
+// the gap from the previous stream exceeds the session gap.
+type SessionStats struct {
+	Sessions         int
+	AverageDuration  time.Duration
+	TracksPerSession float64
+}
+
+// computeSessions splits sorted streams with gaps into sessions.
+func computeSessions(allStreams []endsong.Stream, sessionGap time.Duration) SessionStats {
+	var stats SessionStats
+	var totalDuration time.Duration
+	var sessionStart time.Time
+	for i, s := range allStreams {
+		if i == 0 || s.GapFromPreviousMS == nil || time.Duration(*s.GapFromPreviousMS)*time.Millisecond > sessionGap {
+			if i > 0 {
+				totalDuration += sessionEnd(allStreams[i-1]).Sub(sessionStart)
+			}
+			stats.Sessions++
+			sessionStart = s.Ts
+		}
+	}
+	if stats.Sessions == 0 {
+		return stats
+	}
+	totalDuration += sessionEnd(allStreams[len(allStreams)-1]).Sub(sessionStart)
+
+	stats.AverageDuration = totalDuration / time.Duration(stats.Sessions)
+	stats.TracksPerSession = float64(len(allStreams)) / float64(stats.Sessions)
+	return stats
+}
+
+func sessionEnd(s endsong.Stream) time.Time {
+	return s.Ts.Add(time.Duration(s.MSPlayed) * time.Millisecond)
+}
+
+// streamSkipped reports whether s was skipped, and whether that is known.
+// Newer exports set Skipped explicitly, and an explicit false is trusted as
+// is. Older exports leave it null, in which case ending the stream with the
+// forward or back button counts as skipped and playing it to the end as not
+// skipped; any other reason end leaves it unknown.
+func streamSkipped(s endsong.Stream) (skipped bool, known bool) {
+	if s.Skipped != nil {
+		return *s.Skipped, true
+	}
+
+	switch s.ReasonEnd {
+	case endsong.ReasonEndFwdbtn, endsong.ReasonEndBackbtn:
+		return true, true
+	case endsong.ReasonEndTrackdone:
+		return false, true
+	}
+	return false, false
+}
+
+// DecadeStats is the listening time and play count of tracks released in a
+// decade.
+type DecadeStats struct {
+	Decade   string `json:"decade"`
+	MSPlayed int64  `json:"ms_played"`
+	Plays    int    `json:"plays"`
+}
+
+// computeDecades buckets streams by the decade of their album's release date,
+// that of the stream if set, e.g. by a previous run merged with -merge, or else
+// that of its track's artwork. Streams of tracks without a known release date
+// are left out.
+func computeDecades(allStreams []endsong.Stream, artworkByID map[string]endsong.Artwork) []DecadeStats {
+	var decades []DecadeStats
+	decadeIndex := make(map[string]int)
+	for _, s := range allStreams {
+		var releaseDate string
+		if s.AlbumReleaseDate != nil {
+			releaseDate = *s.AlbumReleaseDate
+		} else {
+			trackID, _ := endsong.TrackIDFromURI(s.SpotifyTrackURI)
+			releaseDate = artworkByID[trackID].ReleaseDate
+		}
+		if len(releaseDate) < 4 {
+			continue
+		}
+
+		decade := releaseDate[:3] + "0s"
+		i, ok := decadeIndex[decade]
+		if !ok {
+			i = len(decades)
+			decades = append(decades, DecadeStats{Decade: decade})
+			decadeIndex[decade] = i
+		}
+		decades[i].MSPlayed += s.MSPlayed
+		decades[i].Plays++
+	}
+	sort.Slice(decades, func(i, j int) bool {
+		return decades[i].Decade < decades[j].Decade
+	})
+
+	return decades
+}
+
+// ArtistStats is the listening time of an artist.
+type ArtistStats struct {
+	Artist   string `json:"artist"`
+	MSPlayed int64  `json:"ms_played"`
+}
+
+// TrackStats is the play count of a track.
+type TrackStats struct {
+	URI    string `json:"spotify_track_uri"`
+	Track  string `json:"track,omitempty"`
+	Artist string `json:"artist,omitempty"`
+	Plays  int    `json:"plays"`
+}
+
+// ListeningStats is an overall summary of the streams.
+type ListeningStats struct {
+	TotalHours     float64       `json:"total_hours"`
+	DistinctTracks int           `json:"distinct_tracks"`
+	From           *time.Time    `json:"from"`
+	To             *time.Time    `json:"to"`
+	TopArtists     []ArtistStats `json:"top_artists"`
+	TopTracks      []TrackStats  `json:"top_tracks"`
+}
+
+// computeListeningStats summarizes the streams, with the n artists with the
+// most ms played and the n tracks with the most plays. Tracks are told apart
+// by URI, as names can be missing or shared, and streams without a track URI
+// (e.g. podcasts) only count towards the total listening time and date range.
+func computeListeningStats(allStreams []endsong.Stream, n int) ListeningStats {
+	var stats ListeningStats
+	var totalMS int64
+	msByArtist := make(map[string]int64)
+	trackByURI := make(map[string]*TrackStats)
+	for i, s := range allStreams {
+		totalMS += s.MSPlayed
+		if stats.From == nil || s.Ts.Before(*stats.From) {
+			stats.From = &allStreams[i].Ts
+		}
+		if stats.To == nil || s.Ts.After(*stats.To) {
+			stats.To = &allStreams[i].Ts
+		}
+		if s.MasterMetadataAlbumArtistName != "" {
+			msByArtist[s.MasterMetadataAlbumArtistName] += s.MSPlayed
+		}
+
+		if _, ok := endsong.TrackIDFromURI(s.SpotifyTrackURI); !ok {
+			continue
+		}
+		track, ok := trackByURI[s.SpotifyTrackURI]
+		if !ok {
+			track = &TrackStats{URI: s.SpotifyTrackURI}
+			trackByURI[s.SpotifyTrackURI] = track
+		}
+		if track.Track == "" {
+			track.Track, track.Artist = s.MasterMetadataTrackName, s.MasterMetadataAlbumArtistName
+		}
+		track.Plays++
+	}
+	stats.TotalHours = float64(totalMS) / float64(time.Hour/time.Millisecond)
+	stats.DistinctTracks = len(trackByURI)
+
+	stats.TopArtists = []ArtistStats{}
+	for _, artist := range topArtistsByMSPlayed(allStreams, n) {
+		stats.TopArtists = append(stats.TopArtists, ArtistStats{Artist: artist, MSPlayed: msByArtist[artist]})
+	}
+
+	stats.TopTracks = make([]TrackStats, 0, len(trackByURI))
+	for _, track := range trackByURI {
+		stats.TopTracks = append(stats.TopTracks, *track)
+	}
+	sort.Slice(stats.TopTracks, func(i, j int) bool {
+		if stats.TopTracks[i].Plays != stats.TopTracks[j].Plays {
+			return stats.TopTracks[i].Plays > stats.TopTracks[j].Plays
+		}
+		return stats.TopTracks[i].URI < stats.TopTracks[j].URI
+	})
+	if len(stats.TopTracks) > n {
+		stats.TopTracks = stats.TopTracks[:n]
+	}
+
+	return stats
+}